@@ -5,12 +5,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
-	"golang.org/x/sys/unix"
-
 	"github.com/Kaya-Sem/oopsie"
 	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
 	"github.com/spf13/cobra"
 )
 
@@ -28,7 +28,7 @@ func init() {
 		Run:   runAdd,
 	}
 
-	addCmd.Flags().StringSliceVarP(&tags, "tag", "t", []string{}, "Tags to add (can be specified multiple times)")
+	addCmd.Flags().StringSliceVarP(&tags, "tag", "t", []string{}, `Tags to add (can be specified multiple times, quote tags containing commas: -t '"a, b"')`)
 	addCmd.MarkFlagRequired("tag")
 
 	rootCmd.AddCommand(addCmd)
@@ -51,46 +51,43 @@ func runAdd(cmd *cobra.Command, args []string) {
 		log.Fatalf("%v", err)
 	}
 
-	// Combine existing and new tags, removing duplicates
-	tagMap := make(map[string]bool)
-	for _, tag := range existingTags {
-		tagMap[tag] = true
-	}
-	for _, tag := range tags {
-		tagMap[tag] = true
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		logFatalWithCaller("err", err)
+		fmt.Print(oopsie.CreateOopsie().Title("Database error").Error(err).IndicatorMessage("SQL").Render())
+		os.Exit(1)
 	}
 
-	// Convert back to slice
-	var allTags []string
-	for tag := range tagMap {
-		if tag != "" {
-			allTags = append(allTags, tag)
-		}
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	// Create the new tag string
-	newTagString := strings.Join(allTags, ",")
+	// Combine existing and new tags, resolving aliases and removing duplicates
+	allTags := aliases.ResolveAll(append(existingTags, tags...))
 
-	setXattr(path, semlinkTagXattrKey, newTagString)
+	// Existing tags that were replaced by their canonical tag
+	var replaced []string
+	for _, tag := range existingTags {
+		if !slices.Contains(allTags, tag) {
+			replaced = append(replaced, tag)
+		}
+	}
 
-	// Get inode for the file info
-	var stat unix.Stat_t
-	if err := unix.Stat(path, &stat); err != nil {
-		log.Fatalf("Failed to stat file: %v", err)
+	for _, tag := range allTags {
+		if err := tagexpr.Validate(tag); err != nil {
+			log.Fatalf("Invalid tag: %v", err)
+		}
 	}
 
-	inode := stat.Ino
+	setSemlinkTags(path, allTags)
 
-	repo, err := repository.NewSqliteRepo()
+	folder, err := statFolder(path)
 	if err != nil {
-		logFatalWithCaller("err", err)
-		fmt.Print(oopsie.CreateOopsie().Title("Database error").Error(err).IndicatorMessage("SQL").Render())
-		os.Exit(1)
+		log.Fatalf("%v", err)
 	}
 
-	folder := repository.FolderInfo{Inode: inode, FullPath: path}
-
-	// TODO: check if folder exists, and create if don't
+	// also brings the path of a moved or recreated folder up to date
 	err = repo.AddFolder(folder)
 	if err != nil {
 
@@ -104,9 +101,15 @@ func runAdd(cmd *cobra.Command, args []string) {
 		log.Fatalf("Could not add tags to folder %s in the database: %v", folder.FullPath, err)
 	}
 
+	if len(replaced) > 0 {
+		if err := repo.RemoveTagsFromFolder(folder, replaced); err != nil {
+			log.Fatalf("Could not remove aliased tags from folder %s in the database: %v", folder.FullPath, err)
+		}
+	}
+
 	if verbose {
 		fmt.Printf("Successfully updated tags for %s\n", path)
-		fmt.Printf("New tags: %s\n", newTagString)
+		fmt.Printf("New tags: %s\n", strings.Join(allTags, ", "))
 	}
 
 	triggerUpdate()
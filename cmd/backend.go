@@ -0,0 +1,339 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// backendSettingKey stores the global backend in the settings table
+const backendSettingKey = "backend"
+
+// backendKind names a way of making a source visible inside a receiver
+type backendKind string
+
+const (
+	backendBind    backendKind = "bind"    // bind mounts, needs root
+	backendSymlink backendKind = "symlink" // symbolic links, works for every user on any filesystem
+)
+
+const defaultBackend = backendBind
+
+var validBackends = []backendKind{backendBind, backendSymlink}
+
+func (kind backendKind) needsPrivileges() bool {
+	return kind != backendSymlink
+}
+
+// linkBackend creates and removes the virtual directories of a receiver
+type linkBackend interface {
+	// link makes the source visible at the virtual path
+	link(l link) error
+	// unlink removes one layer of whatever the backend put at the virtual path
+	unlink(virtual string) error
+	// isLinkOf reports whether the virtual path shows the link's source as wanted
+	isLinkOf(l link) bool
+}
+
+// newLinkBackend returns the backend for the link. The mount backends compare
+// mounts against top, the visible mount per mount point.
+func newLinkBackend(l link, top map[string]mountInfo) linkBackend {
+	switch {
+	case l.lower != nil:
+		return overlayBackend{bindMountBackend{top: top}}
+	case l.backend == backendSymlink:
+		return symlinkBackend{}
+	default:
+		return bindMountBackend{top: top}
+	}
+}
+
+// backendAt returns the backend that made the virtual directory at path, so
+// it can be removed without knowing which receiver it belonged to.
+func backendAt(path string) linkBackend {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return symlinkBackend{}
+	}
+	return bindMountBackend{}
+}
+
+type bindMountBackend struct {
+	top          map[string]mountInfo
+	unmountFlags int // e.g. MNT_DETACH
+}
+
+func (b bindMountBackend) link(l link) error {
+	subDir := l.virtual
+
+	// Create the subdirectory in the target folder
+	err := makeVirtualDirectory(l.target, subDir)
+	if err != nil {
+		return err
+	}
+
+	if useMountHelper() {
+		return helperMountRequest(l.source, subDir, l.readOnly)
+	}
+
+	// Bind mount the source folder to the subdirectory in the target folder
+	err = unix.Mount(l.source, subDir, "", unix.MS_BIND, "")
+	if err != nil {
+		return fmt.Errorf("failed to bind mount %s to %s: %w", l.source, subDir, err)
+	}
+
+	// A bind mount takes the flags of the source mount, read-only needs a remount
+	if l.readOnly {
+		err = unix.Mount("", subDir, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, "")
+		if err != nil {
+			// never leave a writable mount behind in a read-only receiver
+			if unmountErr := unix.Unmount(subDir, 0); unmountErr != nil {
+				return fmt.Errorf("failed to remount %s read-only: %w, and to unmount it: %v", subDir, err, unmountErr)
+			}
+			return fmt.Errorf("failed to remount %s read-only: %w", subDir, err)
+		}
+	}
+
+	return nil
+}
+
+func (b bindMountBackend) unlink(virtual string) error {
+	if useMountHelper() {
+		return helperUnmountRequest(virtual, b.unmountFlags&unix.MNT_DETACH != 0)
+	}
+
+	if err := unix.Unmount(virtual, b.unmountFlags); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", virtual, err)
+	}
+	return nil
+}
+
+func (b bindMountBackend) isLinkOf(l link) bool {
+	mount, ok := b.top[l.virtual]
+	return ok && isSameDirectory(l.source, l.virtual) && mount.readOnly() == l.readOnly
+}
+
+// symlinkBackend points a symbolic link in the receiver at the source. Tools
+// that resolve paths see the source's real location, and there is no
+// read-only mode, but it needs no privileges.
+type symlinkBackend struct{}
+
+func (s symlinkBackend) link(l link) error {
+	if l.readOnly {
+		return fmt.Errorf("can not link %s read-only: read-only receivers need the %s backend", l.virtual, backendBind)
+	}
+
+	// folders a naming template or layout puts between the receiver and the link
+	if parent := filepath.Dir(l.virtual); parent != l.target {
+		if err := makeVirtualDirectory(l.target, parent); err != nil {
+			return err
+		}
+	}
+
+	// an empty virtual directory may be left over from the bind backend
+	if info, err := os.Lstat(l.virtual); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 || isVirtualDirectory(l.virtual) {
+			if err := os.Remove(l.virtual); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", l.virtual, err)
+			}
+		} else {
+			return fmt.Errorf("failed to link %s: a file or folder with that name already exists", l.virtual)
+		}
+	}
+
+	if err := os.Symlink(l.source, l.virtual); err != nil {
+		return fmt.Errorf("failed to symlink %s to %s: %w", l.source, l.virtual, err)
+	}
+
+	return nil
+}
+
+func (s symlinkBackend) unlink(virtual string) error {
+	info, err := os.Lstat(virtual)
+	if err != nil {
+		return fmt.Errorf("failed to remove symlink %s: %w", virtual, err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("failed to remove symlink %s: not a symlink", virtual)
+	}
+	return os.Remove(virtual)
+}
+
+func (s symlinkBackend) isLinkOf(l link) bool {
+	target, err := os.Readlink(l.virtual)
+	return err == nil && target == l.source
+}
+
+func isVirtualDirectory(path string) bool {
+	folderType, err := getSemlinkType(path)
+	return err == nil && Type(folderType) == VIRTUAL
+}
+
+// ownedSymlinks counts the tracked virtual directories that are symlinks, the
+// symlink backend's equivalent of ownedMounts.
+func ownedSymlinks(tracked map[string]bool) map[string]int {
+	owned := make(map[string]int)
+	for virtual := range tracked {
+		if info, err := os.Lstat(virtual); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			owned[virtual] = 1
+		}
+	}
+	return owned
+}
+
+var backendCmd = &cobra.Command{
+	Use:   "backend",
+	Short: "Manage how sources are linked into receivers",
+	Long: `Manage the link backend, globally or per receiver:
+
+  bind     bind mounts, the source looks like a real folder to every program (default, needs root)
+  symlink  symbolic links, works for ordinary users on any filesystem
+
+A receiver without a backend of its own uses the global backend. When the global
+backend is symlink, semlink runs without root, except for receivers using bind.`,
+}
+
+func init() {
+	setCmd := &cobra.Command{
+		Use:       "set [flags] backend [path]",
+		Short:     "Set the global backend, or the backend of a receiver",
+		Args:      cobra.RangeArgs(1, 2),
+		ValidArgs: []string{string(backendBind), string(backendSymlink)},
+		Run:       runBackendSet,
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear [flags] [path]",
+		Short: "Reset the global backend to " + string(defaultBackend) + ", or make a receiver use the global backend",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runBackendClear,
+	}
+
+	backendCmd.AddCommand(setCmd)
+	backendCmd.AddCommand(clearCmd)
+
+	rootCmd.AddCommand(backendCmd)
+}
+
+func runBackendSet(cmd *cobra.Command, args []string) {
+	kind := backendKind(args[0])
+	if !slices.Contains(validBackends, kind) {
+		log.Fatalf("%s is not a valid backend, use one of %v", kind, validBackends)
+	}
+
+	ensureCanUseBackend(kind)
+
+	if len(args) == 2 {
+		path := backendReceiverPath(args[1])
+		setXattr(path, semlinkBackendXattrKey, string(kind))
+	} else {
+		repo, err := repository.NewSqliteRepo()
+		if err != nil {
+			log.Fatalf("Failed to get repository: %v", err)
+		}
+
+		if err := repo.SetSetting(backendSettingKey, string(kind)); err != nil {
+			log.Fatalf("Failed to set backend: %v", err)
+		}
+	}
+
+	if verbose {
+		fmt.Printf("Successfully set backend to %s\n", kind)
+	}
+
+	triggerUpdate()
+}
+
+func runBackendClear(cmd *cobra.Command, args []string) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	if len(args) == 1 {
+		path := backendReceiverPath(args[0])
+
+		// the receiver switches to the global backend
+		kind, err := globalBackend(repo)
+		if err != nil {
+			log.Fatalf("Failed to get the global backend: %v", err)
+		}
+		ensureCanUseBackend(kind)
+
+		err = unix.Removexattr(path, semlinkBackendXattrKey)
+		if err == unix.ENODATA {
+			fmt.Printf("No backend found for %s\n", path)
+			return
+		} else if err != nil {
+			log.Fatalf("Failed to remove backend: %v", err)
+		}
+	} else {
+		ensureCanUseBackend(defaultBackend)
+
+		if err := repo.RemoveSetting(backendSettingKey); err != nil {
+			log.Fatalf("Failed to clear backend: %v", err)
+		}
+	}
+
+	triggerUpdate()
+}
+
+// ensureCanUseBackend checks the privileges needed to switch receivers to a
+// backend. Switching to one that works without root does not need root itself.
+func ensureCanUseBackend(kind backendKind) {
+	if kind.needsPrivileges() {
+		ensureCanMount()
+	}
+}
+
+// backendReceiverPath resolves the receiver argument of the backend commands
+func backendReceiverPath(arg string) string {
+	path, err := filepath.Abs(arg)
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+	return path
+}
+
+// globalBackend returns the backend of receivers without one of their own
+func globalBackend(repo *repository.SqliteRepo) (backendKind, error) {
+	value, err := repo.GetSetting(backendSettingKey)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "" {
+		return defaultBackend, nil
+	}
+
+	if !slices.Contains(validBackends, backendKind(value)) {
+		return "", fmt.Errorf("invalid global backend %q", value)
+	}
+
+	return backendKind(value), nil
+}
+
+// getSemlinkBackend returns the backend of a receiver, or fallback when it has none.
+func getSemlinkBackend(path string, fallback backendKind) (backendKind, error) {
+	value, err := getXattr(path, semlinkBackendXattrKey)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	if !slices.Contains(validBackends, backendKind(value)) {
+		return "", fmt.Errorf("invalid backend %q", value)
+	}
+
+	return backendKind(value), nil
+}
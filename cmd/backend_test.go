@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinkBackend(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "src", "docs")
+	receiver := filepath.Join(dir, "recv")
+	for _, path := range []string{source, receiver} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := link{source: source, target: receiver, virtual: filepath.Join(receiver, "docs"), backend: backendSymlink}
+	backend := newLinkBackend(l, nil)
+
+	if backend.isLinkOf(l) {
+		t.Error("isLinkOf reported a link before it was made")
+	}
+
+	if err := backend.link(l); err != nil {
+		t.Fatalf("link failed: %v", err)
+	}
+	if !backend.isLinkOf(l) {
+		t.Error("isLinkOf did not report the new link")
+	}
+	if _, ok := backendAt(l.virtual).(symlinkBackend); !ok {
+		t.Error("backendAt did not recognise the symlink")
+	}
+
+	// linking again replaces the existing symlink
+	other := filepath.Join(dir, "src", "other")
+	relinked := l
+	relinked.source = other
+	if err := backend.link(relinked); err != nil {
+		t.Fatalf("relink failed: %v", err)
+	}
+	if backend.isLinkOf(l) || !backend.isLinkOf(relinked) {
+		t.Error("relink did not point the symlink at the new source")
+	}
+
+	if err := backend.unlink(l.virtual); err != nil {
+		t.Fatalf("unlink failed: %v", err)
+	}
+	if _, err := os.Lstat(l.virtual); !os.IsNotExist(err) {
+		t.Errorf("symlink still present after unlink: %v", err)
+	}
+	if _, err := os.Stat(source); err != nil {
+		t.Errorf("source was touched by unlink: %v", err)
+	}
+}
+
+func TestSymlinkBackendRefuses(t *testing.T) {
+	dir := t.TempDir()
+	occupied := filepath.Join(dir, "docs")
+	if err := os.Mkdir(occupied, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := symlinkBackend{}
+
+	if err := backend.link(link{source: "/src/docs", target: dir, virtual: occupied}); err == nil {
+		t.Error("expected link to refuse replacing a real folder")
+	}
+	if err := backend.link(link{source: "/src/docs", target: dir, virtual: filepath.Join(dir, "ro"), readOnly: true}); err == nil {
+		t.Error("expected link to refuse a read-only link")
+	}
+	if err := backend.unlink(occupied); err == nil {
+		t.Error("expected unlink to refuse removing a folder")
+	}
+}
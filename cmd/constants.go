@@ -1,8 +1,24 @@
 package cmd
 
 const (
-	semlinkTagXattrKey  = "user.semlink.tags"
-	semlinkTypeXattrKey = "user.semlink.type"
-	defaultType         = "source"
-	registryPermissions = 0755
+	semlinkTagXattrKey      = "user.semlink.tags"
+	semlinkTypeXattrKey     = "user.semlink.type"
+	semlinkQueryXattrKey    = "user.semlink.query"
+	semlinkNamingXattrKey   = "user.semlink.naming"
+	semlinkLayoutXattrKey   = "user.semlink.layout"
+	semlinkModeXattrKey     = "user.semlink.mode"
+	semlinkBackendXattrKey  = "user.semlink.backend"
+	semlinkPriorityXattrKey = "user.semlink.priority"
+	semlinkUpperXattrKey    = "user.semlink.upper"
+	semlinkWorkXattrKey     = "user.semlink.work"
+	defaultType             = "source"
+	registryPermissions     = 0755
+)
+
+// exit codes of the sync command, meant to be checked by boot scripts
+const (
+	exitOK           = 0
+	exitFatal        = 1 // database or mount table could not be read
+	exitMountFailed  = 2 // one or more mounts could not be changed
+	exitPendingMount = 3 // --dry-run found changes that are not applied yet
 )
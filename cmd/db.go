@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+)
+
+var statusFlag bool
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the semlink database",
+	Long:  `Manage the SQLite database semlink keeps its folders, tags and links in.`,
+}
+
+func init() {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade the database schema",
+		Long: `Apply pending schema migrations. Migrations are also applied automatically
+whenever semlink opens the database.`,
+		Args: cobra.NoArgs,
+		Run:  runMigrate,
+	}
+
+	migrateCmd.Flags().BoolVarP(&statusFlag, "status", "s", false, "Show applied and pending migrations without changing the database")
+	dbCmd.AddCommand(migrateCmd)
+
+	rootCmd.AddCommand(dbCmd)
+}
+
+func runMigrate(cmd *cobra.Command, args []string) {
+	if statusFlag {
+		status, err := repository.MigrationStatus()
+		if err != nil {
+			log.Fatalf("Could not read migration status: %v", err)
+		}
+
+		for _, m := range status {
+			state := "pending"
+			if m.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%3d  %-8s %s\n", m.Version, state, m.Description)
+		}
+		return
+	}
+
+	applied, err := repository.Migrate()
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	if len(applied) == 0 {
+		fmt.Println("Database is up to date")
+		return
+	}
+
+	for _, m := range applied {
+		fmt.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+	}
+}
@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var lazyFlag bool
+
+var downCmd = &cobra.Command{
+	Use:     "down",
+	Aliases: []string{"nuke"},
+	Short:   "Unmount and remove all virtual directories",
+	Long: `Unmount every virtual directory semlink mounted inside a receiver and remove the
+directories once they are empty, and remove the symlinks of the symlink backend.
+Only mounts recorded in the database or mounted on a virtual directory are
+touched, other mounts inside a receiver are left alone.
+The contents of the sources are never touched.
+Tags and types are kept, so 'semlink sync' brings everything back.`,
+	Args: cobra.NoArgs,
+	Run:  runDown,
+}
+
+func init() {
+	downCmd.Flags().BoolVarP(&lazyFlag, "lazy", "l", false, "Detach busy mounts instead of failing on them")
+	downCmd.Flags().BoolVarP(&dryRunFlag, "dry-run", "n", false, "Only print the mounts that would be removed")
+
+	rootCmd.AddCommand(downCmd)
+}
+
+func runDown(cmd *cobra.Command, args []string) {
+	if !dryRunFlag {
+		ensureIsPrivileged()
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	folders, err := loadTaggedFolders(repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	receivers := receiverPaths(folders)
+	tracked := trackedLinks(links)
+	owned := ownedMounts(mounts, receivers, tracked, isVirtualDirectory)
+	for virtual, count := range ownedSymlinks(tracked) {
+		owned[virtual] += count
+	}
+	mountPoints := teardownOrder(owned)
+
+	for _, mountPoint := range mountPoints {
+		fmt.Printf("- %s\n", mountPoint)
+	}
+
+	if dryRunFlag {
+		return
+	}
+
+	errs := teardown(repo, mountPoints, lazyFlag)
+	errs = append(errs, forgetUnmountedLinks(repo, links)...)
+	errs = append(errs, removeLeftoverVirtualDirectories(receivers)...)
+
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+
+	if len(errs) > 0 {
+		os.Exit(exitMountFailed)
+	}
+}
+
+// teardownOrder lists every owned mount, stacked mounts once per layer, with
+// nested mounts before their parents.
+func teardownOrder(owned map[string]int) []string {
+	var unique []string
+	for mountPoint := range owned {
+		unique = append(unique, mountPoint)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(unique)))
+
+	var ordered []string
+	for _, mountPoint := range unique {
+		for range owned[mountPoint] {
+			ordered = append(ordered, mountPoint)
+		}
+	}
+
+	return ordered
+}
+
+// teardown unmounts the given mount points and removes the virtual directories
+// that are no longer mounted, together with their links. A directory that is
+// still mounted is never removed.
+func teardown(repo *repository.SqliteRepo, mountPoints []string, lazy bool) []error {
+	flags := 0
+	if lazy {
+		flags = unix.MNT_DETACH
+	}
+
+	var errs []error
+	failed := make(map[string]bool)
+	for _, mountPoint := range mountPoints {
+		backend := backendAt(mountPoint)
+		if bind, ok := backend.(bindMountBackend); ok {
+			bind.unmountFlags = flags
+			backend = bind
+		}
+
+		if err := backend.unlink(mountPoint); err != nil {
+			errs = append(errs, err)
+			failed[mountPoint] = true
+		}
+	}
+
+	for _, mountPoint := range mountPoints {
+		if failed[mountPoint] {
+			continue
+		}
+		if err := removeVirtualDirectory(mountPoint); err != nil {
+			errs = append(errs, err)
+		} else if err := repo.RemoveLink(mountPoint); err != nil {
+			errs = append(errs, err)
+		}
+		failed[mountPoint] = true // only try to remove once
+	}
+
+	return errs
+}
+
+// forgetUnmountedLinks removes the links whose virtual directory is not mounted anymore.
+func forgetUnmountedLinks(repo *repository.SqliteRepo, links []repository.LinkInfo) []error {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return []error{err}
+	}
+
+	mounted := make(map[string]bool)
+	for _, mount := range mounts {
+		mounted[mount.mountPoint] = true
+	}
+
+	var errs []error
+	for _, l := range links {
+		if mounted[l.VirtualPath] {
+			continue
+		}
+
+		if err := removeVirtualDirectory(l.VirtualPath); err != nil {
+			errs = append(errs, err)
+		} else if err := repo.RemoveLink(l.VirtualPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// removeLeftoverVirtualDirectories removes unmounted virtual directories that
+// are still present in the receivers, e.g. after a reboot.
+func removeLeftoverVirtualDirectories(receivers []string) []error {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return []error{err}
+	}
+
+	mounted := make(map[string]bool)
+	for _, mount := range mounts {
+		mounted[mount.mountPoint] = true
+	}
+
+	var errs []error
+	for _, receiver := range receivers {
+		errs = append(errs, removeUnmountedVirtualDirectories(receiver, mounted)...)
+	}
+
+	return errs
+}
+
+// removeUnmountedVirtualDirectories removes the virtual directories inside dir
+// that are not mounted, descending into the folders a naming template like
+// '{tag}/{base}' creates.
+func removeUnmountedVirtualDirectories(dir string, mounted map[string]bool) []error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read %s: %w", dir, err)}
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		subDir := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() || mounted[subDir] {
+			continue
+		}
+
+		folderType, err := getSemlinkType(subDir)
+		if err != nil || Type(folderType) != VIRTUAL {
+			continue
+		}
+
+		errs = append(errs, removeUnmountedVirtualDirectories(subDir, mounted)...)
+		if err := removeVirtualDirectory(subDir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
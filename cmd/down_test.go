@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTeardownOrder(t *testing.T) {
+	owned := map[string]int{
+		"/recv/a":        1,
+		"/recv/a/nested": 1,
+		"/recv/b":        2,
+	}
+
+	want := []string{"/recv/b", "/recv/b", "/recv/a/nested", "/recv/a"}
+	if have := teardownOrder(owned); !reflect.DeepEqual(have, want) {
+		t.Errorf("teardownOrder() = %v, want %v", have, want)
+	}
+}
+
+func TestRemoveLeftoverVirtualDirectories(t *testing.T) {
+	receiver := t.TempDir()
+
+	empty := filepath.Join(receiver, "empty")
+	filled := filepath.Join(receiver, "filled")
+	plain := filepath.Join(receiver, "plain")
+
+	for _, dir := range []string{empty, filled, plain} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+
+	for _, dir := range []string{empty, filled} {
+		if err := setType(dir, VIRTUAL); err != nil {
+			t.Fatalf("Failed to set type: %v", err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(filled, "keep"), []byte("keep"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	errs := removeLeftoverVirtualDirectories([]string{receiver})
+	if len(errs) != 1 {
+		t.Errorf("expected one error for the non-empty virtual directory, got %v", errs)
+	}
+
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Errorf("expected empty virtual directory to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(filled, "keep")); err != nil {
+		t.Errorf("contents of a virtual directory were touched: %v", err)
+	}
+	if _, err := os.Stat(plain); err != nil {
+		t.Errorf("directory without virtual type was removed: %v", err)
+	}
+}
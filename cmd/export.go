@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+)
+
+// systemdTarget groups all mount units, enabling it brings every link up at boot
+const systemdTarget = "semlink.target"
+
+// generatedHeader marks the units semlink wrote, so --install only replaces its own
+const generatedHeader = "# Generated by 'semlink export systemd', changes are overwritten on the next export"
+
+var installDirFlag string
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the links for use by other tools",
+}
+
+var exportSystemdCmd = &cobra.Command{
+	Use:   "systemd",
+	Short: "Generate systemd mount units for the current links",
+	Long: `Generate a .mount unit for every link semlink would mount now, and ` + systemdTarget + `
+which pulls them all in. Bind mounts and unions do not survive a reboot, the units
+bring them back at boot, after the filesystems of the sources and receivers are
+mounted. Links of the symlink backend persist by themselves and are left out.
+
+Without --install the units are printed. With --install they are written to the
+directory, and units from an earlier export that are no longer wanted are removed:
+
+  semlink export systemd --install /etc/systemd/system
+  systemctl daemon-reload
+  systemctl enable --now ` + systemdTarget + `
+
+Export again after changing tags or receivers.`,
+	Args: cobra.NoArgs,
+	Run:  runExportSystemd,
+}
+
+func init() {
+	exportSystemdCmd.Flags().StringVarP(&installDirFlag, "install", "i", "", "Write the units to this directory instead of printing them")
+
+	exportCmd.AddCommand(exportSystemdCmd)
+	rootCmd.AddCommand(exportCmd)
+}
+
+func runExportSystemd(cmd *cobra.Command, args []string) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	folders, err := loadTaggedFolders(repo)
+	if err != nil {
+		log.Fatalf("Failed to load folders: %v", err)
+	}
+
+	units := systemdUnits(desiredLinks(folders))
+
+	if installDirFlag == "" {
+		for _, unit := range units {
+			fmt.Printf("# %s\n%s\n", unit.name, unit.content)
+		}
+		return
+	}
+
+	for _, err := range installUnits(installDirFlag, units) {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+type systemdUnit struct {
+	name    string
+	content string
+}
+
+// systemdUnits returns a mount unit per link, sorted by name, followed by the target
+func systemdUnits(links []link) []systemdUnit {
+	var units []systemdUnit
+	for _, l := range links {
+		if l.backend == backendSymlink {
+			continue
+		}
+		units = append(units, mountUnit(l))
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].name < units[j].name })
+
+	var names []string
+	for _, unit := range units {
+		names = append(names, unit.name)
+	}
+
+	var target bytes.Buffer
+	fmt.Fprintln(&target, generatedHeader)
+	fmt.Fprintln(&target, "[Unit]")
+	fmt.Fprintln(&target, "Description=semlink virtual directories")
+	if len(names) > 0 {
+		fmt.Fprintf(&target, "Wants=%s\n", strings.Join(names, " "))
+	}
+	fmt.Fprintln(&target)
+	fmt.Fprintln(&target, "[Install]")
+	fmt.Fprintln(&target, "WantedBy=multi-user.target")
+
+	return append(units, systemdUnit{name: systemdTarget, content: target.String()})
+}
+
+// mountUnit describes the link as a mount unit. systemd orders it after the
+// mount units of its parent directories by itself, RequiresMountsFor adds the
+// filesystems of the sources.
+func mountUnit(l link) systemdUnit {
+	what, fsType, from := l.source, "none", l.source
+	options := []string{"bind"}
+	required := []string{l.source, l.target}
+
+	if l.lower != nil {
+		what, fsType, from = "overlay", "overlay", strings.Join(l.lower, ", ")
+		options = []string{"lowerdir=" + strings.Join(l.lower, ":")}
+		required = append([]string{l.target}, l.lower...)
+		if l.upper != "" {
+			options = append(options, "upperdir="+l.upper, "workdir="+l.work)
+			required = append(required, l.upper, l.work)
+		}
+	}
+	if l.readOnly {
+		options = append(options, "ro")
+	}
+
+	var quoted []string
+	for _, path := range required {
+		quoted = append(quoted, quoteUnitWord(path))
+	}
+
+	var unit bytes.Buffer
+	fmt.Fprintln(&unit, generatedHeader)
+	fmt.Fprintln(&unit, "[Unit]")
+	fmt.Fprintf(&unit, "Description=semlink: %s in %s\n", escapeSpecifiers(from), escapeSpecifiers(l.target))
+	fmt.Fprintf(&unit, "RequiresMountsFor=%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(&unit, "PartOf=%s\n", systemdTarget)
+	fmt.Fprintf(&unit, "Before=%s\n", systemdTarget)
+	fmt.Fprintln(&unit)
+	fmt.Fprintln(&unit, "[Mount]")
+	fmt.Fprintf(&unit, "What=%s\n", escapeSpecifiers(what))
+	fmt.Fprintf(&unit, "Where=%s\n", l.virtual)
+	fmt.Fprintf(&unit, "Type=%s\n", fsType)
+	fmt.Fprintf(&unit, "Options=%s\n", escapeSpecifiers(strings.Join(options, ",")))
+
+	return systemdUnit{name: escapeUnitPath(l.virtual) + ".mount", content: unit.String()}
+}
+
+// escapeUnitPath escapes a path into a unit name like 'systemd-escape --path',
+// mount units have to be named after their mount point.
+func escapeUnitPath(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-"
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			escaped.WriteByte('-')
+		case c == '.' && i == 0:
+			// a leading dot would make a hidden name
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.':
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		}
+	}
+	return escaped.String()
+}
+
+// escapeSpecifiers keeps systemd from expanding % in a value
+func escapeSpecifiers(value string) string {
+	return strings.ReplaceAll(value, "%", "%%")
+}
+
+// quoteUnitWord makes a path one word of a space separated list
+func quoteUnitWord(path string) string {
+	path = escapeSpecifiers(path)
+	if !strings.ContainsAny(path, " \t\"'\\") {
+		return path
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path) + `"`
+}
+
+// installUnits writes the units to dir and removes the mount units of an
+// earlier export that are no longer wanted. Other units are never touched.
+func installUnits(dir string, units []systemdUnit) []error {
+	var errs []error
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return []error{fmt.Errorf("failed to create %s: %w", dir, err)}
+	}
+
+	wanted := make(map[string]bool)
+	for _, unit := range units {
+		wanted[unit.name] = true
+
+		path := filepath.Join(dir, unit.name)
+		if current, err := os.ReadFile(path); err == nil {
+			if string(current) == unit.content {
+				continue
+			}
+			if !isGeneratedUnit(current) {
+				errs = append(errs, fmt.Errorf("not replacing %s, it was not written by semlink", path))
+				continue
+			}
+		}
+
+		if err := os.WriteFile(path, []byte(unit.content), 0644); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %w", path, err))
+			continue
+		}
+		fmt.Printf("+ %s\n", path)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return append(errs, fmt.Errorf("failed to read %s: %w", dir, err))
+	}
+
+	for _, entry := range entries {
+		if wanted[entry.Name()] || !strings.HasSuffix(entry.Name(), ".mount") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if content, err := os.ReadFile(path); err != nil || !isGeneratedUnit(content) {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", path, err))
+			continue
+		}
+		fmt.Printf("- %s\n", path)
+	}
+
+	return errs
+}
+
+func isGeneratedUnit(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(generatedHeader+"\n"))
+}
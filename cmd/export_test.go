@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEscapeUnitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "-"},
+		{"/home/me/recv/src", "home-me-recv-src"},
+		{"/home/me/recv/src/", "home-me-recv-src"},
+		{"/home/me/my-dir", `home-me-my\x2ddir`},
+		{"/home/me/a b", `home-me-a\x20b`},
+		{"/home/me/.config/v1.2", "home-me-.config-v1.2"},
+		{"/.hidden", `\x2ehidden`},
+		{"/srv/ü", `srv-\xc3\xbc`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeUnitPath(tt.path); got != tt.want {
+			t.Errorf("escapeUnitPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSystemdUnits(t *testing.T) {
+	units := systemdUnits([]link{
+		{source: "/data/src", target: "/home/me/recv", virtual: "/home/me/recv/src", backend: backendBind, readOnly: true},
+		{source: "/data/other", target: "/home/me/recv", virtual: "/home/me/recv/other", backend: backendSymlink},
+		{target: "/home/me/union", virtual: "/home/me/union/all", lower: []string{"/a", "/b c"}, upper: "/u", work: "/w"},
+	})
+
+	var names []string
+	for _, unit := range units {
+		names = append(names, unit.name)
+	}
+	want := []string{"home-me-recv-src.mount", "home-me-union-all.mount", systemdTarget}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("units = %v, want %v", names, want)
+	}
+
+	for _, line := range []string{
+		"What=/data/src\n",
+		"Where=/home/me/recv/src\n",
+		"Type=none\n",
+		"Options=bind,ro\n",
+		"RequiresMountsFor=/data/src /home/me/recv\n",
+	} {
+		if !strings.Contains(units[0].content, line) {
+			t.Errorf("bind unit lacks %q:\n%s", line, units[0].content)
+		}
+	}
+
+	for _, line := range []string{
+		"Type=overlay\n",
+		"Options=lowerdir=/a:/b c,upperdir=/u,workdir=/w\n",
+		`RequiresMountsFor=/home/me/union /a "/b c" /u /w` + "\n",
+	} {
+		if !strings.Contains(units[1].content, line) {
+			t.Errorf("union unit lacks %q:\n%s", line, units[1].content)
+		}
+	}
+
+	if !strings.Contains(units[2].content, "Wants=home-me-recv-src.mount home-me-union-all.mount\n") {
+		t.Errorf("target does not want the mounts:\n%s", units[2].content)
+	}
+}
+
+func TestInstallUnits(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "old.mount")
+	foreign := filepath.Join(dir, "foreign.mount")
+	os.WriteFile(stale, []byte(generatedHeader+"\n[Mount]\n"), 0644)
+	os.WriteFile(foreign, []byte("[Mount]\n"), 0644)
+
+	units := []systemdUnit{{name: "new.mount", content: generatedHeader + "\n"}}
+	if errs := installUnits(dir, units); len(errs) != 0 {
+		t.Fatalf("installUnits: %v", errs)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "new.mount")); err != nil {
+		t.Errorf("new unit not written: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale generated unit kept")
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("unit not written by semlink removed")
+	}
+
+	units = []systemdUnit{{name: "foreign.mount", content: generatedHeader + "\n"}}
+	if errs := installUnits(dir, units); len(errs) != 1 {
+		t.Errorf("replacing a foreign unit gave %v, want one error", errs)
+	}
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var filterCmd = &cobra.Command{
+	Use:   "filter",
+	Short: "Manage receiver queries",
+	Long: `Manage the tag expression a receiver uses to select sources.
+A receiver with a query receives every source that satisfies it, for example
+'work AND rust AND NOT archived', instead of the sources sharing one of its tags.
+NOT binds tighter than AND, which binds tighter than OR. Use parentheses to group.`,
+}
+
+func init() {
+	setCmd := &cobra.Command{
+		Use:   "set [flags] expression path",
+		Short: "Set the query of a receiver",
+		Args:  cobra.ExactArgs(2),
+		Run:   runFilterSet,
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear [flags] path",
+		Short: "Remove the query of a receiver, so it matches on its tags again",
+		Args:  cobra.ExactArgs(1),
+		Run:   runFilterClear,
+	}
+
+	filterCmd.AddCommand(setCmd)
+	filterCmd.AddCommand(clearCmd)
+
+	rootCmd.AddCommand(filterCmd)
+}
+
+func runFilterSet(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	expression := args[0]
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	query, err := tagexpr.Parse(expression)
+	if err != nil {
+		log.Fatalf("Invalid query: %v", err)
+	}
+
+	setXattr(path, semlinkQueryXattrKey, expression)
+
+	if verbose {
+		fmt.Printf("Successfully set query for %s\n", path)
+		fmt.Printf("Parsed query: %s\n", query)
+	}
+
+	triggerUpdate()
+}
+
+func runFilterClear(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	err = unix.Removexattr(path, semlinkQueryXattrKey)
+	if err == unix.ENODATA {
+		fmt.Printf("No query found for %s\n", path)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to remove query: %v", err)
+	}
+
+	triggerUpdate()
+}
+
+func ensureIsReceiver(path string) {
+	folderType, err := getSemlinkType(path)
+	if err != nil {
+		log.Fatalf("Could not get type for %s: %v", path, err)
+	}
+
+	if Type(folderType) != RECEIVER {
+		log.Fatalf("%s is not a receiver. Set its type first with 'semlink type set receiver %s'", path, path)
+	}
+}
@@ -0,0 +1,536 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// The mount helper is the only part of semlink that has to run as root. The
+// CLI runs as the user and sends it mount requests over a Unix socket.
+//
+// Protocol: the client writes one request per line as a JSON object and reads
+// one JSON answer per line, until it closes the connection.
+//
+//	{"op":"ping"}
+//	{"op":"mount","source":"/home/me/src","target":"/home/me/recv/src","read_only":true}
+//	{"op":"unmount","target":"/home/me/recv/src","lazy":false}
+//
+// Every answer is {"ok":true} or {"ok":false,"error":"reason"}. Paths have to
+// be absolute, clean and free of symlinks. The helper acts for the user on the
+// other end of the socket and only
+//
+//   - bind mounts a source directory that user owns onto an empty virtual
+//     directory (user.semlink.type=virtual) that user owns, optionally read-only
+//   - unmounts a mount whose root and mount point's parent that user owns
+//
+// Root is allowed everything the protocol describes. Nothing else is offered:
+// no overlays, no recursive bind mounts, no mount options.
+
+// defaultHelperSocket is where the helper listens, SEMLINK_HELPER_SOCKET overrides it
+const defaultHelperSocket = "/run/semlink/helper.sock"
+
+// helperTimeout bounds a single request, so a stuck helper does not hang the CLI
+const helperTimeout = 10 * time.Second
+
+const (
+	helperPing    = "ping"
+	helperMount   = "mount"
+	helperUnmount = "unmount"
+)
+
+type helperRequest struct {
+	Op       string `json:"op"`
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	Lazy     bool   `json:"lazy,omitempty"`
+}
+
+type helperResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+var helperSocketFlag string
+
+var mountHelperCmd = &cobra.Command{
+	Use:   "mount-helper",
+	Short: "Run the privileged helper that makes bind mounts for ordinary users",
+	Long: `Run the mount helper as root, so all other semlink commands can run as the user.
+It only bind mounts sources onto virtual directories the requesting user owns and
+unmounts them again, and never reads the database. Union receivers still need root.
+
+The helper can be started by systemd through socket activation:
+
+  # /etc/systemd/system/semlink-helper.socket
+  [Socket]
+  ListenStream=` + defaultHelperSocket + `
+  SocketMode=0666
+
+  [Install]
+  WantedBy=sockets.target
+
+  # /etc/systemd/system/semlink-helper.service
+  [Service]
+  ExecStart=/usr/local/bin/semlink mount-helper
+
+The protocol is one JSON object per line in each direction:
+
+  {"op":"mount","source":"/abs/source","target":"/abs/receiver/source","read_only":false}
+  {"op":"unmount","target":"/abs/receiver/source","lazy":false}
+  {"op":"ping"}
+
+and every request is answered with {"ok":true} or {"ok":false,"error":"..."}.`,
+	Args: cobra.NoArgs,
+	Run:  runMountHelper,
+}
+
+func init() {
+	mountHelperCmd.Flags().StringVar(&helperSocketFlag, "socket", defaultHelperSocket, "Socket to listen on when not started by systemd")
+
+	rootCmd.AddCommand(mountHelperCmd)
+}
+
+func runMountHelper(cmd *cobra.Command, args []string) {
+	if err := mountPermission(); err != nil {
+		log.Fatalf("The mount helper can not mount: %v", err)
+	}
+
+	listener, err := helperListener(helperSocketFlag)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", helperSocketFlag, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	// one request at a time, the mount table is shared
+	var mu sync.Mutex
+	handle := func(uid uint32, req helperRequest) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return handleHelperRequest(uid, req)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+
+			uid, err := peerUID(conn.(*net.UnixConn))
+			if err != nil {
+				log.Printf("Failed to identify client: %v", err)
+				return
+			}
+			serveHelperConn(conn, uid, handle)
+		}()
+	}
+}
+
+// helperListener uses the socket systemd passed on, or listens on path
+func helperListener(path string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") == "1" {
+		// the first passed file descriptor is always 3
+		return net.FileListener(os.NewFile(3, "systemd socket"))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// every user may connect, what they may do is checked per request
+	if err := os.Chmod(path, 0666); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+
+	return cred.Uid, nil
+}
+
+// serveHelperConn answers the requests on one connection
+func serveHelperConn(conn io.ReadWriter, uid uint32, handle func(uint32, helperRequest) error) {
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req helperRequest
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			err = fmt.Errorf("invalid request: %w", err)
+		} else {
+			err = handle(uid, req)
+		}
+
+		response := helperResponse{OK: err == nil}
+		if err != nil {
+			response.Error = err.Error()
+			log.Printf("uid %d: %s %s refused: %v", uid, req.Op, req.Target, err)
+		}
+
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func handleHelperRequest(uid uint32, req helperRequest) error {
+	switch req.Op {
+	case helperPing:
+		return nil
+	case helperMount:
+		return helperBindMount(uid, req.Source, req.Target, req.ReadOnly)
+	case helperUnmount:
+		return helperUnmountTarget(uid, req.Target, req.Lazy)
+	default:
+		return fmt.Errorf("unknown op %q", req.Op)
+	}
+}
+
+// openHelperPath opens a directory without following any symlink, so the path
+// can not be swapped for another one between the checks and the mount.
+func openHelperPath(path string) (int, unix.Stat_t, error) {
+	var stat unix.Stat_t
+
+	if err := checkHelperPath(path); err != nil {
+		return -1, stat, err
+	}
+
+	fd, err := unix.Openat2(unix.AT_FDCWD, path, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS,
+	})
+	if err != nil {
+		return -1, stat, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	if err := unix.Fstat(fd, &stat); err != nil {
+		unix.Close(fd)
+		return -1, stat, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	return fd, stat, nil
+}
+
+func checkHelperPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("%q is not an absolute, clean path", path)
+	}
+	return nil
+}
+
+// fdPath refers to an opened file, mount follows it to exactly that directory
+func fdPath(fd int) string {
+	return "/proc/self/fd/" + strconv.Itoa(fd)
+}
+
+func checkOwner(uid uint32, stat unix.Stat_t, path string) error {
+	if uid != 0 && stat.Uid != uid {
+		return fmt.Errorf("%s is not owned by uid %d", path, uid)
+	}
+	return nil
+}
+
+func helperBindMount(uid uint32, source string, target string, readOnly bool) error {
+	sourceFd, sourceStat, err := openHelperPath(source)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sourceFd)
+
+	targetFd, targetStat, err := openHelperPath(target)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(targetFd)
+
+	if err := checkOwner(uid, sourceStat, source); err != nil {
+		return err
+	}
+	if err := checkOwner(uid, targetStat, target); err != nil {
+		return err
+	}
+
+	folderType, err := getXattr(fdPath(targetFd), semlinkTypeXattrKey)
+	if err != nil || Type(folderType) != VIRTUAL {
+		return fmt.Errorf("%s is not a virtual directory", target)
+	}
+
+	entries, err := os.ReadDir(fdPath(targetFd))
+	if err != nil || len(entries) > 0 {
+		return fmt.Errorf("%s is not an empty directory", target)
+	}
+
+	if err := unix.Mount(fdPath(sourceFd), fdPath(targetFd), "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s to %s: %w", source, target, err)
+	}
+
+	if !readOnly {
+		return nil
+	}
+
+	// the new mount is only reachable through the path, check it is ours
+	mountFd, mountStat, err := openHelperPath(target)
+	if err == nil {
+		defer unix.Close(mountFd)
+		if mountStat.Dev != sourceStat.Dev || mountStat.Ino != sourceStat.Ino {
+			err = fmt.Errorf("%s changed while mounting", target)
+		}
+	}
+	if err == nil {
+		err = unix.Mount("", fdPath(mountFd), "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, "")
+	}
+
+	if err != nil {
+		// never leave a writable mount behind in a read-only receiver
+		unix.Unmount(target, unix.MNT_DETACH)
+		return fmt.Errorf("failed to remount %s read-only: %w", target, err)
+	}
+
+	return nil
+}
+
+// helperUnmountTarget only unmounts what semlink mounted: a bind mount or union
+// of semlink sources on a virtual directory, so a user can not unmount other
+// mounts inside their own directories through the helper.
+func helperUnmountTarget(uid uint32, target string, lazy bool) error {
+	targetFd, targetStat, err := openHelperPath(target)
+	if err != nil {
+		return err
+	}
+	mountedType, err := getXattr(fdPath(targetFd), semlinkTypeXattrKey)
+	// an open descriptor would keep the mount busy
+	unix.Close(targetFd)
+	if err != nil {
+		return err
+	}
+
+	parent := filepath.Dir(target)
+	parentFd, parentStat, err := openHelperPath(parent)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parentFd)
+
+	// the root of the mount is the source, the parent is the receiver
+	if err := checkOwner(uid, targetStat, target); err != nil {
+		return err
+	}
+	if err := checkOwner(uid, parentStat, parent); err != nil {
+		return err
+	}
+
+	covered, err := coveredType(parentFd, filepath.Base(target))
+	if err != nil {
+		return err
+	}
+	if covered != VIRTUAL {
+		return fmt.Errorf("%s is not a virtual directory", target)
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+	if err := checkSemlinkMount(topMounts(mounts), target, Type(mountedType), isSourceFolder); err != nil {
+		return err
+	}
+
+	flags := unix.UMOUNT_NOFOLLOW
+	if lazy {
+		flags |= unix.MNT_DETACH
+	}
+
+	// unmount by name inside the checked parent, so no part of the path can
+	// be swapped for a symlink in between. Requests are serialized, nothing
+	// else depends on the working directory.
+	if err := unix.Fchdir(parentFd); err != nil {
+		return fmt.Errorf("failed to enter %s: %w", parent, err)
+	}
+	defer os.Chdir("/")
+
+	if err := unix.Unmount(filepath.Base(target), flags); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// coveredType reads the semlink type of the directory a mount hides. It looks
+// in a copy of the parent's mount, which leaves out the mounts on top of it.
+func coveredType(parentFd int, name string) (Type, error) {
+	tree, err := unix.OpenTree(parentFd, "", unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_EMPTY_PATH)
+	if err != nil {
+		return "", fmt.Errorf("failed to look below the mount at %s: %w", name, err)
+	}
+	defer unix.Close(tree)
+
+	fd, err := unix.Openat2(tree, name, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_BENEATH,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to open the directory below the mount at %s: %w", name, err)
+	}
+	defer unix.Close(fd)
+
+	folderType, err := getXattr(fdPath(fd), semlinkTypeXattrKey)
+	return Type(folderType), err
+}
+
+// checkSemlinkMount checks that the visible mount at target shows a semlink
+// source, or is a union of semlink sources. mountedType is the semlink type of
+// the mounted directory.
+func checkSemlinkMount(top map[string]mountInfo, target string, mountedType Type, isSource func(string) bool) error {
+	mount, ok := top[target]
+	if !ok {
+		return fmt.Errorf("%s is not a mount point", target)
+	}
+
+	if mount.fsType != "overlay" {
+		if mountedType != SOURCE {
+			return fmt.Errorf("%s is not a bind mount of a semlink source", target)
+		}
+		return nil
+	}
+
+	lower, ok := mount.superOption("lowerdir")
+	if !ok {
+		return fmt.Errorf("%s is not a semlink union", target)
+	}
+	for _, layer := range strings.Split(lower, ":") {
+		if !isSource(layer) {
+			return fmt.Errorf("%s is not a union of semlink sources, %s is not a source", target, layer)
+		}
+	}
+	return nil
+}
+
+func isSourceFolder(path string) bool {
+	folderType, err := getSemlinkType(path)
+	return err == nil && Type(folderType) == SOURCE
+}
+
+// helperSocket returns the socket the CLI sends its mount requests to
+func helperSocket() string {
+	if socket := os.Getenv("SEMLINK_HELPER_SOCKET"); socket != "" {
+		return socket
+	}
+	return defaultHelperSocket
+}
+
+// callHelper sends one request to the helper and waits for the answer
+func callHelper(socket string, req helperRequest) error {
+	conn, err := net.DialTimeout("unix", socket, helperTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to reach the mount helper: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(helperTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send to the mount helper: %w", err)
+	}
+
+	var response helperResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("failed to read from the mount helper: %w", err)
+	}
+
+	if !response.OK {
+		return fmt.Errorf("mount helper: %s", response.Error)
+	}
+	return nil
+}
+
+// mountHelperAvailable is checked once, whether a helper answers on the socket
+var mountHelperAvailable = sync.OnceValue(func() bool {
+	return callHelper(helperSocket(), helperRequest{Op: helperPing}) == nil
+})
+
+// useMountHelper reports whether mounts go through the helper instead of
+// being made by this process.
+func useMountHelper() bool {
+	return !isPrivileged() && mountHelperAvailable()
+}
+
+// helperMountRequest asks the helper to bind mount source onto target. The
+// helper refuses symlinks, so both are resolved first.
+func helperMountRequest(source string, target string, readOnly bool) error {
+	source, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", source, err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", target, err)
+	}
+
+	return callHelper(helperSocket(), helperRequest{Op: helperMount, Source: source, Target: resolved, ReadOnly: readOnly})
+}
+
+func helperUnmountRequest(target string, lazy bool) error {
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", target, err)
+	}
+
+	return callHelper(helperSocket(), helperRequest{Op: helperUnmount, Target: resolved, Lazy: lazy})
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestServeHelperConn(t *testing.T) {
+	input := strings.Join([]string{
+		`{"op":"ping"}`,
+		`not json`,
+		`{"op":"mount","source":"/a","target":"/b","read_only":true}`,
+	}, "\n") + "\n"
+
+	var output bytes.Buffer
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(input), &output}
+
+	var got []helperRequest
+	serveHelperConn(conn, 1000, func(uid uint32, req helperRequest) error {
+		if uid != 1000 {
+			t.Errorf("handled request for uid %d, want 1000", uid)
+		}
+		got = append(got, req)
+		if req.Op == helperMount {
+			return errors.New("refused")
+		}
+		return nil
+	})
+
+	want := []helperRequest{{Op: helperPing}, {Op: helperMount, Source: "/a", Target: "/b", ReadOnly: true}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+
+	answers := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(answers) != 3 {
+		t.Fatalf("got %d answers, want 3: %q", len(answers), output.String())
+	}
+	if answers[0] != `{"ok":true}` {
+		t.Errorf("ping answered %s", answers[0])
+	}
+	if !strings.HasPrefix(answers[1], `{"ok":false,"error":"invalid request`) {
+		t.Errorf("invalid JSON answered %s", answers[1])
+	}
+	if answers[2] != `{"ok":false,"error":"refused"}` {
+		t.Errorf("refused mount answered %s", answers[2])
+	}
+}
+
+func TestCallHelper(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serveHelperConn(conn, 0, func(uid uint32, req helperRequest) error {
+				if req.Op != helperPing {
+					return errors.New("not allowed")
+				}
+				return nil
+			})
+			conn.Close()
+		}
+	}()
+
+	if err := callHelper(socket, helperRequest{Op: helperPing}); err != nil {
+		t.Errorf("ping failed: %v", err)
+	}
+
+	err = callHelper(socket, helperRequest{Op: helperUnmount, Target: "/x"})
+	if err == nil || err.Error() != "mount helper: not allowed" {
+		t.Errorf("unmount error = %v, want the helper's answer", err)
+	}
+
+	if err := callHelper(filepath.Join(t.TempDir(), "missing.sock"), helperRequest{Op: helperPing}); err == nil {
+		t.Errorf("ping without a helper succeeded")
+	}
+}
+
+func TestCheckHelperPath(t *testing.T) {
+	for _, path := range []string{"/home/me/src", "/"} {
+		if err := checkHelperPath(path); err != nil {
+			t.Errorf("checkHelperPath(%q) = %v, want nil", path, err)
+		}
+	}
+
+	for _, path := range []string{"", "relative", "/home/me/../root", "/home/me/", "/home//me"} {
+		if err := checkHelperPath(path); err == nil {
+			t.Errorf("checkHelperPath(%q) = nil, want an error", path)
+		}
+	}
+}
+
+func TestCheckOwner(t *testing.T) {
+	owned := unix.Stat_t{Uid: 1000}
+
+	if err := checkOwner(1000, owned, "/a"); err != nil {
+		t.Errorf("owner refused: %v", err)
+	}
+	if err := checkOwner(0, owned, "/a"); err != nil {
+		t.Errorf("root refused: %v", err)
+	}
+	if err := checkOwner(1001, owned, "/a"); err == nil {
+		t.Errorf("other user allowed")
+	}
+}
+
+func TestCheckSemlinkMount(t *testing.T) {
+	top := map[string]mountInfo{
+		"/home/me/recv/src":   {mountPoint: "/home/me/recv/src", root: "/home/me/src", fsType: "ext4"},
+		"/home/me/recv/usb":   {mountPoint: "/home/me/recv/usb", root: "/", fsType: "vfat"},
+		"/home/me/recv/union": {mountPoint: "/home/me/recv/union", fsType: "overlay", superOptions: "rw,lowerdir=/home/me/a:/home/me/b"},
+		"/home/me/recv/mixed": {mountPoint: "/home/me/recv/mixed", fsType: "overlay", superOptions: "rw,lowerdir=/home/me/a:/etc"},
+	}
+	isSource := func(path string) bool { return strings.HasPrefix(path, "/home/me/") }
+
+	tests := []struct {
+		target      string
+		mountedType Type
+		allowed     bool
+	}{
+		{"/home/me/recv/src", SOURCE, true},
+		{"/home/me/recv/union", "", true},
+		{"/home/me/recv/usb", "", false},   // a foreign mount inside the receiver
+		{"/home/me/recv/mixed", "", false}, // a union with a layer that is not a source
+		{"/home/me/recv/gone", SOURCE, false},
+	}
+
+	for _, tt := range tests {
+		err := checkSemlinkMount(top, tt.target, tt.mountedType, isSource)
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkSemlinkMount(%q) = %v, allowed want %v", tt.target, err, tt.allowed)
+		}
+	}
+}
@@ -2,9 +2,14 @@ package cmd
 
 import (
 	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
-	"log"
 )
 
 func init() {
@@ -33,8 +38,6 @@ func displaySemlinkXAttrs(path string) {
 		return
 	}
 
-	inode := stat.Ino
-
 	folderType, err := getSemlinkType(path)
 	if err != nil {
 		log.Printf("Error getting semlink type for %s: %v", path, err)
@@ -46,9 +49,60 @@ func displaySemlinkXAttrs(path string) {
 	}
 
 	fmt.Printf("Path: %s\n", path)
-	fmt.Printf("Inode: %d\n", inode)
+	fmt.Printf("Device: %d:%d\n", unix.Major(uint64(stat.Dev)), unix.Minor(uint64(stat.Dev)))
+	fmt.Printf("Inode: %d\n", stat.Ino)
 	fmt.Printf("Type: %s\n", folderType)
 
+	if Type(folderType) == RECEIVER {
+		query, err := getXattr(path, semlinkQueryXattrKey)
+		if err != nil {
+			log.Printf("Error getting semlink query for %s: %v", path, err)
+			return
+		}
+
+		if query != "" {
+			fmt.Printf("Query: %s\n", query)
+		}
+
+		naming, err := getSemlinkNaming(path)
+		if err != nil {
+			log.Printf("Error getting semlink naming template for %s: %v", path, err)
+			return
+		}
+
+		fmt.Printf("Naming: %s\n", naming)
+
+		receiverLayout, err := getSemlinkLayout(path)
+		if err != nil {
+			log.Printf("Error getting semlink layout for %s: %v", path, err)
+			return
+		}
+
+		fmt.Printf("Layout: %s\n", receiverLayout)
+
+		mode, err := getSemlinkMode(path)
+		if err != nil {
+			log.Printf("Error getting semlink mode for %s: %v", path, err)
+			return
+		}
+
+		fmt.Printf("Mode: %s\n", mode)
+
+		backend, err := getSemlinkBackend(path, "")
+		if err != nil {
+			log.Printf("Error getting semlink backend for %s: %v", path, err)
+			return
+		}
+
+		if backend != "" {
+			fmt.Printf("Backend: %s\n", backend)
+		} else {
+			fmt.Printf("Backend: %s (global)\n", inspectGlobalBackend())
+		}
+	}
+
+	displayMount(path, Type(folderType))
+
 	tags, err := getSemlinkTags(path)
 	if err != nil {
 		log.Printf("Error getting semlink tags for %s: %v", path, err)
@@ -62,6 +116,84 @@ func displaySemlinkXAttrs(path string) {
 
 	fmt.Println("Parsed tags:")
 	for _, tag := range tags {
-		fmt.Printf("  %s\n", tag)
+		fmt.Printf("  %s\n", describeTag(tag))
+	}
+}
+
+// displayMount shows the effective flags when path is a mount point. A mounted
+// virtual directory shows the xattrs of its source, so it is looked up in the
+// mount table rather than by type.
+func displayMount(path string, folderType Type) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		log.Printf("Error reading mount table: %v", err)
+		return
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		log.Printf("Failed to resolve absolute path: %v", err)
+		return
+	}
+
+	if mount, ok := topMounts(mounts)[absPath]; ok {
+		if lower, ok := mount.superOption("lowerdir"); ok && mount.fsType == "overlay" {
+			fmt.Printf("Union of: %s\n", strings.ReplaceAll(lower, ":", ", "))
+			if upper, ok := mount.superOption("upperdir"); ok {
+				fmt.Printf("Writes to: %s\n", upper)
+			}
+		} else if source, ok := linkedSource(absPath); ok {
+			fmt.Printf("Mounted from: %s\n", source)
+		} else {
+			// not mounted by semlink, mountinfo only knows the path inside the filesystem
+			fmt.Printf("Filesystem root: %s on %s (device %s)\n", mount.root, mount.source, mount.device)
+		}
+		fmt.Printf("Mount flags: %s\n", mount.options)
+	} else if folderType == VIRTUAL {
+		fmt.Println("Mounted from: not mounted")
+	}
+}
+
+// linkedSource returns the source recorded in the links table for a virtual directory
+func linkedSource(virtual string) (string, bool) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		return "", false
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		return "", false
+	}
+
+	for _, l := range links {
+		if l.VirtualPath == virtual {
+			return l.Source, true
+		}
+	}
+	return "", false
+}
+
+// inspectGlobalBackend returns the global backend, or the default one when the
+// database can not be read.
+func inspectGlobalBackend() backendKind {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		return defaultBackend
+	}
+
+	kind, err := globalBackend(repo)
+	if err != nil {
+		return defaultBackend
+	}
+	return kind
+}
+
+// describeTag shows a tag together with the ancestors it inherits, e.g. "lang/go (inherits lang)"
+func describeTag(tag string) string {
+	ancestors := tagexpr.Ancestors(tag)
+	if len(ancestors) == 0 {
+		return tag
 	}
+	return fmt.Sprintf("%s (inherits %s)", tag, strings.Join(ancestors, ", "))
 }
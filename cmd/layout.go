@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// layout decides how a receiver arranges its virtual directories
+type layout string
+
+const (
+	layoutFlat     layout = "flat"      // every source directly inside the receiver
+	layoutTagged   layout = "tagged"    // <receiver>/<tag>/<source>, once for every matching tag
+	layoutFirstTag layout = "first-tag" // <receiver>/<tag>/<source>, only under the first matching tag
+	layoutUnion    layout = "union"     // one overlay of all sources, see union.go
+)
+
+var validLayouts = []layout{layoutFlat, layoutTagged, layoutFirstTag, layoutUnion}
+
+func (l layout) groupsByTag() bool {
+	return l == layoutTagged || l == layoutFirstTag
+}
+
+var layoutCmd = &cobra.Command{
+	Use:   "layout",
+	Short: "Manage how receivers arrange their virtual directories",
+	Long: `Manage the layout of a receiver:
+
+  flat       every source directly inside the receiver (default)
+  tagged     one folder per tag, a source matching several tags appears under each of them
+  first-tag  one folder per tag, a source matching several tags only appears under the first
+  union      one merged view of all sources, see 'semlink union --help'
+
+The first tag is the first matching tag of the receiver, or the first tag named by its query.
+Sources selected by a query without naming a tag, e.g. 'NOT archived', go into '` + untaggedName + `'.
+The naming template names the folders inside the tag folders.`,
+}
+
+func init() {
+	setCmd := &cobra.Command{
+		Use:       "set [flags] layout path",
+		Short:     "Set the layout of a receiver",
+		Args:      cobra.ExactArgs(2),
+		ValidArgs: []string{string(layoutFlat), string(layoutTagged), string(layoutFirstTag), string(layoutUnion)},
+		Run:       runLayoutSet,
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear [flags] path",
+		Short: "Remove the layout of a receiver, so it is " + string(layoutFlat) + " again",
+		Args:  cobra.ExactArgs(1),
+		Run:   runLayoutClear,
+	}
+
+	layoutCmd.AddCommand(setCmd)
+	layoutCmd.AddCommand(clearCmd)
+
+	rootCmd.AddCommand(layoutCmd)
+}
+
+func runLayoutSet(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	receiverLayout := layout(args[0])
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	if !slices.Contains(validLayouts, receiverLayout) {
+		log.Fatalf("%s is not a valid layout, use one of %v", receiverLayout, validLayouts)
+	}
+
+	setXattr(path, semlinkLayoutXattrKey, string(receiverLayout))
+
+	if verbose {
+		fmt.Printf("Successfully set layout for %s to %s\n", path, receiverLayout)
+	}
+
+	triggerUpdate()
+}
+
+func runLayoutClear(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	err = unix.Removexattr(path, semlinkLayoutXattrKey)
+	if err == unix.ENODATA {
+		fmt.Printf("No layout found for %s\n", path)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to remove layout: %v", err)
+	}
+
+	triggerUpdate()
+}
+
+// getSemlinkLayout returns the layout of a receiver, or flat when it has none.
+func getSemlinkLayout(path string) (layout, error) {
+	value, err := getXattr(path, semlinkLayoutXattrKey)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "" {
+		return layoutFlat, nil
+	}
+
+	if !slices.Contains(validLayouts, layout(value)) {
+		return "", fmt.Errorf("invalid layout %q", value)
+	}
+
+	return layout(value), nil
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// mountMode decides whether a receiver can write back to its sources
+type mountMode string
+
+const (
+	modeReadWrite mountMode = "rw"
+	modeReadOnly  mountMode = "ro"
+)
+
+var validModes = []mountMode{modeReadWrite, modeReadOnly}
+
+var modeCmd = &cobra.Command{
+	Use:   "mode",
+	Short: "Manage whether receivers can write to their sources",
+	Long: `Manage the mount mode of a receiver. Sources are mounted read-write ('rw') by
+default, so anything written through the receiver changes the source. A read-only
+('ro') receiver is a view that can never write back.`,
+}
+
+func init() {
+	setCmd := &cobra.Command{
+		Use:       "set [flags] rw|ro path",
+		Short:     "Set the mount mode of a receiver",
+		Args:      cobra.ExactArgs(2),
+		ValidArgs: []string{string(modeReadWrite), string(modeReadOnly)},
+		Run:       runModeSet,
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear [flags] path",
+		Short: "Remove the mount mode of a receiver, so it is " + string(modeReadWrite) + " again",
+		Args:  cobra.ExactArgs(1),
+		Run:   runModeClear,
+	}
+
+	modeCmd.AddCommand(setCmd)
+	modeCmd.AddCommand(clearCmd)
+
+	rootCmd.AddCommand(modeCmd)
+}
+
+func runModeSet(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	mode := mountMode(args[0])
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	if !slices.Contains(validModes, mode) {
+		log.Fatalf("%s is not a valid mode, use one of %v", mode, validModes)
+	}
+
+	setXattr(path, semlinkModeXattrKey, string(mode))
+
+	if verbose {
+		fmt.Printf("Successfully set mode for %s to %s\n", path, mode)
+	}
+
+	triggerUpdate()
+}
+
+func runModeClear(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	err = unix.Removexattr(path, semlinkModeXattrKey)
+	if err == unix.ENODATA {
+		fmt.Printf("No mode found for %s\n", path)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to remove mode: %v", err)
+	}
+
+	triggerUpdate()
+}
+
+// getSemlinkMode returns the mount mode of a receiver, or rw when it has none.
+func getSemlinkMode(path string) (mountMode, error) {
+	value, err := getXattr(path, semlinkModeXattrKey)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "" {
+		return modeReadWrite, nil
+	}
+
+	if !slices.Contains(validModes, mountMode(value)) {
+		return "", fmt.Errorf("invalid mode %q", value)
+	}
+
+	return mountMode(value), nil
+}
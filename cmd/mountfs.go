@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/spf13/cobra"
+)
+
+// tagFSRefresh is how long the tag filesystem serves a snapshot of the
+// repository before reading it again, and how long the kernel caches entries.
+const tagFSRefresh = time.Second
+
+// selectorSeparator joins the tags of an intersection, e.g. work+rust
+const selectorSeparator = "+"
+
+var (
+	allowOtherFlag bool
+	fuseDebugFlag  bool
+)
+
+var mountFSCmd = &cobra.Command{
+	Use:   "mount-fs [flags] mountpoint",
+	Short: "Serve the tags as a FUSE filesystem",
+	Long: `Serve a filesystem in which every tag is a directory containing the sources tagged
+with it: <mountpoint>/<tag>/<source>. Intersections are reached by joining tags with
+'+', <mountpoint>/work+rust/ shows the sources tagged both work and rust. They are
+not listed, but can be opened by name.
+
+Tags containing '/', '+' or '%' are escaped like in URLs, lang/go becomes lang%2Fgo.
+Reads and writes pass through to the real folders. The filesystem follows changes
+to the tags within a second. It runs until it is unmounted or interrupted.
+
+No receivers or bind mounts are needed, and it works without root.`,
+	Args: cobra.ExactArgs(1),
+	Run:  runMountFS,
+}
+
+func init() {
+	mountFSCmd.Flags().BoolVar(&allowOtherFlag, "allow-other", false, "Let other users access the filesystem, needs user_allow_other in /etc/fuse.conf")
+	mountFSCmd.Flags().BoolVar(&fuseDebugFlag, "debug", false, "Log every FUSE request")
+
+	rootCmd.AddCommand(mountFSCmd)
+}
+
+func runMountFS(cmd *cobra.Command, args []string) {
+	mountPoint, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	tags := &tagFS{load: func() (tagSnapshot, error) { return loadTagSnapshot(repo) }}
+	if _, err := tags.current(); err != nil {
+		log.Fatalf("Failed to read repository: %v", err)
+	}
+
+	timeout := tagFSRefresh
+	server, err := fs.Mount(mountPoint, &tagRootNode{tags: tags}, &fs.Options{
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: &timeout,
+		MountOptions: fuse.MountOptions{
+			AllowOther: allowOtherFlag,
+			FsName:     "semlink",
+			Name:       "semlink",
+			Debug:      fuseDebugFlag,
+			// mount directly when running as root, fusermount otherwise
+			DirectMount: true,
+			// let the kernel check permissions, the passthrough runs as this process
+			Options: []string{"default_permissions"},
+		},
+	})
+	if err != nil {
+		log.Fatalf("Failed to mount %s: %v", mountPoint, err)
+	}
+
+	fmt.Printf("Serving tags at %s, unmount with 'fusermount -u %s' or press Ctrl+C\n", mountPoint, mountPoint)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := server.Unmount(); err != nil {
+			log.Printf("Failed to unmount %s: %v", mountPoint, err)
+		}
+	}()
+
+	server.Wait()
+}
+
+// tagSnapshot is the state of the repository the filesystem serves
+type tagSnapshot struct {
+	tags    []string // every tag and its ancestors, sorted
+	sources []taggedFolder
+	aliases tagexpr.Aliases
+}
+
+func loadTagSnapshot(repo *repository.SqliteRepo) (tagSnapshot, error) {
+	folders, err := loadTaggedFolders(repo)
+	if err != nil {
+		return tagSnapshot{}, err
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		return tagSnapshot{}, err
+	}
+
+	return newTagSnapshot(folders, aliases), nil
+}
+
+func newTagSnapshot(folders []taggedFolder, aliases tagexpr.Aliases) tagSnapshot {
+	snapshot := tagSnapshot{aliases: aliases}
+
+	for _, folder := range folders {
+		if folder.folderType != SOURCE {
+			continue
+		}
+		snapshot.sources = append(snapshot.sources, folder)
+
+		for _, tag := range folder.tags {
+			for _, t := range append(tagexpr.Ancestors(tag), tag) {
+				if !slices.Contains(snapshot.tags, t) {
+					snapshot.tags = append(snapshot.tags, t)
+				}
+			}
+		}
+	}
+
+	sort.Strings(snapshot.tags)
+	return snapshot
+}
+
+// selector parses a directory name into the tags it intersects. A name that
+// is a tag itself wins over splitting it, so c++ still works unescaped.
+func (s tagSnapshot) selector(name string) ([]string, bool) {
+	if tag, err := url.PathUnescape(name); err == nil && slices.Contains(s.tags, s.aliases.Resolve(tagexpr.Normalize(tag))) {
+		return []string{s.aliases.Resolve(tagexpr.Normalize(tag))}, true
+	}
+
+	var selected []string
+	for _, part := range strings.Split(name, selectorSeparator) {
+		tag, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, false
+		}
+
+		tag = s.aliases.Resolve(tagexpr.Normalize(tag))
+		if !slices.Contains(s.tags, tag) {
+			return nil, false
+		}
+		selected = append(selected, tag)
+	}
+
+	return selected, true
+}
+
+// entries returns the sources carrying every selected tag by name. Sources
+// with the same name get their inode appended, in path order.
+func (s tagSnapshot) entries(selected []string) map[string]taggedFolder {
+	entries := make(map[string]taggedFolder)
+
+	for _, source := range s.sources {
+		if !coversAll(selected, source.tags) {
+			continue
+		}
+
+		name := path.Base(source.path)
+		if _, taken := entries[name]; taken {
+			name = fmt.Sprintf("%s-%d", name, source.inode)
+		}
+		entries[name] = source
+	}
+
+	return entries
+}
+
+// coversAll reports whether every selected tag covers one of the tags, so
+// lang selects sources tagged lang/go.
+func coversAll(selected []string, tags []string) bool {
+	for _, tag := range selected {
+		if len(sharedTags([]string{tag}, tags)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeTagName makes a tag usable as a single directory name
+func escapeTagName(tag string) string {
+	return strings.NewReplacer("%", "%25", "/", "%2F", selectorSeparator, "%2B").Replace(tag)
+}
+
+// tagFS caches the snapshot for tagFSRefresh, so listing a directory does not
+// read the repository and all xattrs for every entry.
+type tagFS struct {
+	load func() (tagSnapshot, error)
+
+	mu       sync.Mutex
+	snapshot tagSnapshot
+	loadedAt time.Time
+}
+
+func (t *tagFS) current() (tagSnapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.loadedAt) < tagFSRefresh {
+		return t.snapshot, nil
+	}
+
+	snapshot, err := t.load()
+	if err != nil {
+		if t.loadedAt.IsZero() {
+			return tagSnapshot{}, err
+		}
+
+		// keep serving the last snapshot, e.g. while the database is locked
+		log.Printf("Failed to refresh tags: %v", err)
+		return t.snapshot, nil
+	}
+
+	t.snapshot = snapshot
+	t.loadedAt = time.Now()
+	return snapshot, nil
+}
+
+// tagRootNode lists every tag as a directory
+type tagRootNode struct {
+	fs.Inode
+	tags *tagFS
+}
+
+var _ = (fs.NodeReaddirer)((*tagRootNode)(nil))
+var _ = (fs.NodeLookuper)((*tagRootNode)(nil))
+var _ = (fs.NodeGetattrer)((*tagRootNode)(nil))
+
+func (n *tagRootNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0555
+	return fs.OK
+}
+
+func (n *tagRootNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	snapshot, _ := n.tags.current()
+
+	var entries []fuse.DirEntry
+	for _, tag := range snapshot.tags {
+		entries = append(entries, fuse.DirEntry{Name: escapeTagName(tag), Mode: fuse.S_IFDIR})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *tagRootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	snapshot, _ := n.tags.current()
+
+	selected, ok := snapshot.selector(name)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	out.Mode = fuse.S_IFDIR | 0555
+	return n.NewInode(ctx, &tagDirNode{tags: n.tags, selected: selected}, fs.StableAttr{Mode: fuse.S_IFDIR}), fs.OK
+}
+
+// tagDirNode lists the sources carrying all selected tags
+type tagDirNode struct {
+	fs.Inode
+	tags     *tagFS
+	selected []string
+}
+
+var _ = (fs.NodeReaddirer)((*tagDirNode)(nil))
+var _ = (fs.NodeLookuper)((*tagDirNode)(nil))
+var _ = (fs.NodeGetattrer)((*tagDirNode)(nil))
+
+func (n *tagDirNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0555
+	return fs.OK
+}
+
+func (n *tagDirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	snapshot, _ := n.tags.current()
+
+	var entries []fuse.DirEntry
+	for name := range snapshot.entries(n.selected) {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (n *tagDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	snapshot, _ := n.tags.current()
+
+	source, ok := snapshot.entries(n.selected)[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(source.path, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+
+	// Dev 0 mixes the device into every inode number, so sources on different
+	// filesystems never share inode numbers
+	root := &fs.LoopbackRoot{Path: source.path}
+	node := &fs.LoopbackNode{RootData: root}
+	root.RootNode = node
+
+	swapped := (uint64(st.Dev) << 32) | (uint64(st.Dev) >> 32)
+	stable := fs.StableAttr{Mode: fuse.S_IFDIR, Gen: 1, Ino: swapped ^ st.Ino}
+
+	return n.NewInode(ctx, node, stable), fs.OK
+}
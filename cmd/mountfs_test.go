@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+)
+
+func testSnapshot() tagSnapshot {
+	return newTagSnapshot([]taggedFolder{
+		{path: "/src/a/docs", folderType: SOURCE, inode: 1, tags: []string{"work", "lang/go"}},
+		{path: "/src/b/docs", folderType: SOURCE, inode: 2, tags: []string{"work"}},
+		{path: "/src/cli", folderType: SOURCE, inode: 3, tags: []string{"lang/rust", "c++"}},
+		{path: "/recv", folderType: RECEIVER, inode: 4, tags: []string{"work"}},
+	}, tagexpr.Aliases{"golang": "lang/go"})
+}
+
+func TestTagSnapshotTags(t *testing.T) {
+	want := []string{"c++", "lang", "lang/go", "lang/rust", "work"}
+	if tags := testSnapshot().tags; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+}
+
+func TestTagSnapshotSelector(t *testing.T) {
+	snapshot := testSnapshot()
+
+	tests := []struct {
+		name     string
+		selected []string
+		ok       bool
+	}{
+		{"work", []string{"work"}, true},
+		{"lang%2Fgo", []string{"lang/go"}, true},
+		{"golang", []string{"lang/go"}, true},
+		{"c++", []string{"c++"}, true},
+		{"c%2B%2B", []string{"c++"}, true},
+		{"work+lang%2Fgo", []string{"work", "lang/go"}, true},
+		{"Work+lang", nil, false},
+		{"work+missing", nil, false},
+		{"missing", nil, false},
+		{"work+", nil, false},
+	}
+
+	for _, tt := range tests {
+		selected, ok := snapshot.selector(tt.name)
+		if ok != tt.ok || !reflect.DeepEqual(selected, tt.selected) {
+			t.Errorf("selector(%q) = %v, %v; want %v, %v", tt.name, selected, ok, tt.selected, tt.ok)
+		}
+	}
+}
+
+func TestTagSnapshotEntries(t *testing.T) {
+	snapshot := testSnapshot()
+
+	names := func(selected ...string) []string {
+		var result []string
+		for name := range snapshot.entries(selected) {
+			result = append(result, name)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	if got, want := names("work"), []string{"docs", "docs-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries(work) = %v, want %v", got, want)
+	}
+	if got, want := names("lang"), []string{"cli", "docs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries(lang) = %v, want %v", got, want)
+	}
+	if got, want := names("work", "lang"), []string{"docs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries(work+lang) = %v, want %v", got, want)
+	}
+	if snapshot.entries([]string{"work"})["docs"].path != "/src/a/docs" {
+		t.Error("expected the lowest path to keep the plain name")
+	}
+}
+
+func TestEscapeTagName(t *testing.T) {
+	snapshot := testSnapshot()
+	for _, tag := range snapshot.tags {
+		if selected, ok := snapshot.selector(escapeTagName(tag)); !ok || !reflect.DeepEqual(selected, []string{tag}) {
+			t.Errorf("selector(escapeTagName(%q)) = %v, %v", tag, selected, ok)
+		}
+	}
+}
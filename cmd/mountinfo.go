@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// mountInfo is a single line of /proc/self/mountinfo. See proc(5) for the format.
+type mountInfo struct {
+	id           int
+	parentID     int
+	device       string // major:minor
+	root         string
+	mountPoint   string
+	options      string
+	fsType       string
+	source       string
+	superOptions string // still escaped, see superOption
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", mountInfoPath, err)
+	}
+	defer file.Close()
+
+	return parseMountInfo(file)
+}
+
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+
+	scanner := bufio.NewScanner(r)
+	// an overlay with many layers has a long line
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		// optional fields are terminated by a single hyphen
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+
+		if len(fields) < 6 || separator == -1 || len(fields) < separator+4 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mount id in %q: %w", line, err)
+		}
+
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed parent id in %q: %w", line, err)
+		}
+
+		mounts = append(mounts, mountInfo{
+			id:           id,
+			parentID:     parentID,
+			device:       fields[2],
+			root:         unescapeMountField(fields[3]),
+			mountPoint:   unescapeMountField(fields[4]),
+			options:      fields[5],
+			fsType:       fields[separator+1],
+			source:       unescapeMountField(fields[separator+2]),
+			superOptions: fields[separator+3],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %w", err)
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 for a space, ...) the kernel uses in mountinfo
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+
+	return b.String()
+}
+
+// superOption returns the value of a filesystem specific option, like the
+// lowerdir of an overlay. Options are split before unescaping, so values can
+// contain escaped commas.
+func (m mountInfo) superOption(name string) (string, bool) {
+	for _, option := range strings.Split(m.superOptions, ",") {
+		if value, ok := strings.CutPrefix(option, name+"="); ok {
+			return unescapeMountField(value), true
+		}
+	}
+	return "", false
+}
+
+// readOnly reports whether the mount itself is read-only, regardless of the
+// superblock options of the filesystem.
+func (m mountInfo) readOnly() bool {
+	return slices.Contains(strings.Split(m.options, ","), "ro")
+}
+
+// topMounts returns the visible mount at every mount point. A mount stacked on
+// top of another one comes later in the mount table.
+func topMounts(mounts []mountInfo) map[string]mountInfo {
+	top := make(map[string]mountInfo)
+	for _, mount := range mounts {
+		top[mount.mountPoint] = mount
+	}
+	return top
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	input := `22 1 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+98 29 259:2 /home/user/src/my\040project /home/user/receiver/my\040project rw,relatime shared:1 master:2 - ext4 /dev/nvme0n1p2 rw
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseMountInfo failed: %v", err)
+	}
+
+	if len(mounts) != 2 {
+		t.Fatalf("expected 2 mounts, got %d", len(mounts))
+	}
+
+	want := mountInfo{
+		id:           98,
+		parentID:     29,
+		device:       "259:2",
+		root:         "/home/user/src/my project",
+		mountPoint:   "/home/user/receiver/my project",
+		options:      "rw,relatime",
+		fsType:       "ext4",
+		source:       "/dev/nvme0n1p2",
+		superOptions: "rw",
+	}
+	if mounts[1] != want {
+		t.Errorf("parsed mount = %+v, want %+v", mounts[1], want)
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	_, err := parseMountInfo(strings.NewReader("22 1 0:21 / /proc rw shared:12 proc proc rw\n"))
+	if err == nil {
+		t.Error("expected error for line without separator")
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	tests := []struct {
+		field    string
+		expected string
+	}{
+		{"/plain", "/plain"},
+		{`/with\040space`, "/with space"},
+		{`/tab\011and\134backslash`, "/tab\tand\\backslash"},
+		{`/trailing\04`, `/trailing\04`},
+	}
+
+	for _, tt := range tests {
+		if result := unescapeMountField(tt.field); result != tt.expected {
+			t.Errorf("unescapeMountField(%q) = %q, want %q", tt.field, result, tt.expected)
+		}
+	}
+}
+
+func TestTopMounts(t *testing.T) {
+	mounts := []mountInfo{
+		{id: 1, mountPoint: "/recv/docs", options: "rw,relatime"},
+		{id: 2, mountPoint: "/recv/notes", options: "ro,relatime"},
+		{id: 3, mountPoint: "/recv/docs", options: "ro,nosuid,relatime"},
+	}
+
+	top := topMounts(mounts)
+
+	if top["/recv/docs"].id != 3 {
+		t.Errorf("top mount of /recv/docs = %d, want the stacked mount 3", top["/recv/docs"].id)
+	}
+	if !top["/recv/docs"].readOnly() || !top["/recv/notes"].readOnly() {
+		t.Error("expected both top mounts to be read-only")
+	}
+	if mounts[0].readOnly() {
+		t.Error("rw,relatime reported as read-only")
+	}
+}
+
+func TestSuperOption(t *testing.T) {
+	mount := mountInfo{superOptions: `rw,lowerdir=/src/a\054b:/src/c,upperdir=/up,workdir=/work,xino=off`}
+
+	if lower, ok := mount.superOption("lowerdir"); !ok || lower != "/src/a,b:/src/c" {
+		t.Errorf("superOption(lowerdir) = %q, %v", lower, ok)
+	}
+	if upper, ok := mount.superOption("upperdir"); !ok || upper != "/up" {
+		t.Errorf("superOption(upperdir) = %q, %v", upper, ok)
+	}
+	if _, ok := mount.superOption("redirect_dir"); ok {
+		t.Error("superOption found a missing option")
+	}
+}
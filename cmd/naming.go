@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// defaultNamingTemplate mounts every source under its own name
+const defaultNamingTemplate = "{base}"
+
+// untaggedName replaces {tag} for links that were not made because of a tag,
+// e.g. through a query like 'NOT archived'
+const untaggedName = "untagged"
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+var namingPlaceholders = []string{"{base}", "{parent}", "{inode}", "{tag}"}
+
+var namingCmd = &cobra.Command{
+	Use:   "naming",
+	Short: "Manage how receivers name their virtual directories",
+	Long: `Manage the template a receiver uses to name the virtual directory of each source.
+The template is a relative path that can use these placeholders:
+
+  {base}    name of the source folder
+  {parent}  name of the folder containing the source
+  {inode}   inode number of the source
+  {tag}     tag the source was linked by, hierarchical tags become nested folders
+
+For example '{base}-{inode}', '{parent}_{base}' or '{tag}/{base}'. The default is '{base}'.
+When two sources end up with the same name, the source with the lowest path keeps it
+and the others get their inode appended.`,
+}
+
+func init() {
+	setCmd := &cobra.Command{
+		Use:   "set [flags] template path",
+		Short: "Set the naming template of a receiver",
+		Args:  cobra.ExactArgs(2),
+		Run:   runNamingSet,
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear [flags] path",
+		Short: "Remove the naming template of a receiver, so it uses '" + defaultNamingTemplate + "' again",
+		Args:  cobra.ExactArgs(1),
+		Run:   runNamingClear,
+	}
+
+	namingCmd.AddCommand(setCmd)
+	namingCmd.AddCommand(clearCmd)
+
+	rootCmd.AddCommand(namingCmd)
+}
+
+func runNamingSet(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	template := args[0]
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	if err := validateNamingTemplate(template); err != nil {
+		log.Fatalf("Invalid naming template: %v", err)
+	}
+
+	setXattr(path, semlinkNamingXattrKey, template)
+
+	if verbose {
+		fmt.Printf("Successfully set naming template for %s to %s\n", path, template)
+	}
+
+	triggerUpdate()
+}
+
+func runNamingClear(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	err = unix.Removexattr(path, semlinkNamingXattrKey)
+	if err == unix.ENODATA {
+		fmt.Printf("No naming template found for %s\n", path)
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to remove naming template: %v", err)
+	}
+
+	triggerUpdate()
+}
+
+// getSemlinkNaming returns the naming template of a receiver, or the default
+// when it has none.
+func getSemlinkNaming(path string) (string, error) {
+	template, err := getXattr(path, semlinkNamingXattrKey)
+	if err != nil {
+		return "", err
+	}
+
+	if template == "" {
+		return defaultNamingTemplate, nil
+	}
+
+	if err := validateNamingTemplate(template); err != nil {
+		return "", fmt.Errorf("invalid naming template %q: %w", template, err)
+	}
+
+	return template, nil
+}
+
+func validateNamingTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if !slices.Contains(namingPlaceholders, placeholder) {
+			return fmt.Errorf("unknown placeholder %s, use one of %s", placeholder, strings.Join(namingPlaceholders, ", "))
+		}
+	}
+
+	if strings.ContainsAny(placeholderPattern.ReplaceAllString(template, ""), "{}") {
+		return fmt.Errorf("unbalanced braces in %q", template)
+	}
+
+	if !strings.Contains(template, "{base}") && !strings.Contains(template, "{inode}") {
+		return fmt.Errorf("template has to contain {base} or {inode} to tell sources apart")
+	}
+
+	sample := expandNamingTemplate(template, taggedFolder{path: "/source/folder", inode: 1}, "tag")
+	if !filepath.IsLocal(sample) || strings.HasPrefix(template, "/") {
+		return fmt.Errorf("template has to be a path inside the receiver")
+	}
+
+	return nil
+}
+
+// expandNamingTemplate fills in the template for a source linked because of
+// tag. The result is a relative path inside the receiver.
+func expandNamingTemplate(template string, source taggedFolder, tag string) string {
+	if tag == "" {
+		tag = untaggedName
+	}
+
+	replacer := strings.NewReplacer(
+		"{base}", path.Base(source.path),
+		"{parent}", path.Base(path.Dir(source.path)),
+		"{inode}", strconv.FormatUint(source.inode, 10),
+		"{tag}", tag,
+	)
+
+	return path.Clean(replacer.Replace(template))
+}
+
+// virtualPath returns where the receiver mounts the source. A template that
+// would escape the receiver, e.g. through a tag like '..', falls back to the
+// default template.
+func (receiver taggedFolder) virtualPath(source taggedFolder, tag string) string {
+	template := receiver.naming
+	if template == "" {
+		template = defaultNamingTemplate
+	}
+	if receiver.layout.groupsByTag() {
+		template = "{tag}/" + template
+	}
+
+	name := expandNamingTemplate(template, source, tag)
+	if !filepath.IsLocal(name) || name == "." {
+		name = expandNamingTemplate(defaultNamingTemplate, source, tag)
+	}
+	return path.Join(receiver.path, name)
+}
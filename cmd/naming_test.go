@@ -0,0 +1,52 @@
+package cmd
+
+import "testing"
+
+func TestValidateNamingTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{"{base}", true},
+		{"{base}-{inode}", true},
+		{"{parent}_{base}", true},
+		{"{tag}/{base}", true},
+		{"{inode}", true},
+		{"{tag}", false},
+		{"{name}", false},
+		{"{base", false},
+		{"/{base}", false},
+		{"../{base}", false},
+	}
+
+	for _, tt := range tests {
+		err := validateNamingTemplate(tt.template)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateNamingTemplate(%q) = %v, want valid %v", tt.template, err, tt.valid)
+		}
+	}
+}
+
+func TestVirtualPath(t *testing.T) {
+	source := taggedFolder{path: "/home/me/projects/docs", inode: 42}
+
+	tests := []struct {
+		naming string
+		tag    string
+		want   string
+	}{
+		{"", "work", "/recv/docs"},
+		{"{base}-{inode}", "work", "/recv/docs-42"},
+		{"{parent}_{base}", "work", "/recv/projects_docs"},
+		{"{tag}/{base}", "lang/go", "/recv/lang/go/docs"},
+		{"{tag}/{base}", "", "/recv/untagged/docs"},
+		{"{tag}/{base}", "..", "/recv/docs"}, // escapes the receiver, falls back to the default
+	}
+
+	for _, tt := range tests {
+		receiver := taggedFolder{path: "/recv", naming: tt.naming}
+		if got := receiver.virtualPath(source, tt.tag); got != tt.want {
+			t.Errorf("virtualPath(%q, %q) = %s, want %s", tt.naming, tt.tag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountCapability is what the kernel checks for mount(2) and umount(2)
+const (
+	mountCapability     = unix.CAP_SYS_ADMIN
+	mountCapabilityName = "CAP_SYS_ADMIN"
+)
+
+// mountPermission is checked once, the probe mounts a directory
+var mountPermission = sync.OnceValue(checkMountPermission)
+
+// checkMountPermission returns why this process can not mount, or nil when it
+// can. Running as root is not enough: root in a container often has no
+// CAP_SYS_ADMIN, or a seccomp or AppArmor profile blocks mount anyway. A binary
+// with the capability through setcap can mount without being root.
+func checkMountPermission() error {
+	effective, permitted, err := capabilityState(mountCapability)
+	if err != nil {
+		return fmt.Errorf("failed to read the capabilities of semlink: %w", err)
+	}
+
+	if !effective {
+		return missingCapabilityError(permitted)
+	}
+
+	if err := probeMount(); err != nil {
+		return blockedMountError(err)
+	}
+
+	return nil
+}
+
+// capabilityState reports whether the capability is in the effective and in
+// the permitted set of this process.
+func capabilityState(capability int) (bool, bool, error) {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData // version 3 uses two 32 bit words
+
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return false, false, err
+	}
+
+	word, bit := data[capability/32], uint32(1)<<(capability%32)
+	return word.Effective&bit != 0, word.Permitted&bit != 0, nil
+}
+
+func missingCapabilityError(permitted bool) error {
+	if permitted {
+		return fmt.Errorf("%s is permitted but not effective, set it with 'setcap cap_sys_admin+ep' instead of '+p'", mountCapabilityName)
+	}
+	return fmt.Errorf("%s is missing from the effective capabilities", mountCapabilityName)
+}
+
+func blockedMountError(err error) error {
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		return fmt.Errorf("%s is effective but mounting is still denied (%w), a container, seccomp filter or security module like AppArmor or SELinux blocks mount", mountCapabilityName, err)
+	}
+	return fmt.Errorf("%s is effective but a test mount failed: %w", mountCapabilityName, err)
+}
+
+// probeMount bind mounts an empty directory onto itself and removes it again
+func probeMount() error {
+	dir, err := os.MkdirTemp("", "semlink-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	if err := unix.Mount(dir, dir, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+
+	if err := unix.Unmount(dir, 0); err != nil {
+		// never leave the probe behind, even if it is busy
+		unix.Unmount(dir, unix.MNT_DETACH)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMissingCapabilityError(t *testing.T) {
+	if err := missingCapabilityError(false); !strings.Contains(err.Error(), "missing") {
+		t.Errorf("missingCapabilityError(false) = %v, want it to say the capability is missing", err)
+	}
+	if err := missingCapabilityError(true); !strings.Contains(err.Error(), "permitted but not effective") {
+		t.Errorf("missingCapabilityError(true) = %v, want it to say the capability is not effective", err)
+	}
+}
+
+func TestBlockedMountError(t *testing.T) {
+	err := blockedMountError(unix.EPERM)
+	if !errors.Is(err, unix.EPERM) || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("blockedMountError(EPERM) = %v, want a denied mount wrapping EPERM", err)
+	}
+
+	err = blockedMountError(unix.ENOSPC)
+	if !errors.Is(err, unix.ENOSPC) || strings.Contains(err.Error(), "denied") {
+		t.Errorf("blockedMountError(ENOSPC) = %v, want a failed test mount wrapping ENOSPC", err)
+	}
+}
+
+func TestCapabilityState(t *testing.T) {
+	effective, permitted, err := capabilityState(unix.CAP_SYS_ADMIN)
+	if err != nil {
+		t.Fatalf("capabilityState: %v", err)
+	}
+	if effective && !permitted {
+		t.Errorf("CAP_SYS_ADMIN is effective but not permitted, which the kernel does not allow")
+	}
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"github.com/spf13/cobra"
+)
+
+var (
+	jsonFlag bool
+	nullFlag bool
+)
+
+var queryCmd = &cobra.Command{
+	Use:   "query [flags] expression",
+	Short: "Find folders by tag expression",
+	Long: `List the registered folders whose tags satisfy a tag expression, for example
+'work AND (rust OR go*) AND NOT archived'. NOT binds tighter than AND, which binds
+tighter than OR. Tags containing * or ? are wildcards.
+
+Use --null to separate paths with NUL characters for 'xargs -0'.`,
+	Args: cobra.ExactArgs(1),
+	Run:  runQuery,
+}
+
+func init() {
+	queryCmd.Flags().BoolVarP(&jsonFlag, "json", "j", false, "Print the matches as JSON")
+	queryCmd.Flags().BoolVarP(&nullFlag, "null", "0", false, "Print only paths, separated by NUL characters")
+	queryCmd.MarkFlagsMutuallyExclusive("json", "null")
+
+	rootCmd.AddCommand(queryCmd)
+}
+
+type queryMatch struct {
+	Path      string   `json:"path"`
+	Type      string   `json:"type"`
+	Tags      []string `json:"tags"`
+	Inherited []string `json:"inherited"` // ancestors of the tags, e.g. lang for lang/go
+	Device    uint64   `json:"device"`
+	Inode     uint64   `json:"inode"`
+}
+
+func runQuery(cmd *cobra.Command, args []string) {
+	expr, err := tagexpr.Parse(args[0])
+	if err != nil {
+		log.Fatalf("Invalid query: %v", err)
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	matches := matchFolders(aliases.ResolveExpr(expr), folders, aliases)
+
+	switch {
+	case jsonFlag:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(matches); err != nil {
+			log.Fatalf("Failed to encode matches: %v", err)
+		}
+	case nullFlag:
+		for _, match := range matches {
+			fmt.Printf("%s\x00", match.Path)
+		}
+	default:
+		for _, match := range matches {
+			var described []string
+			for _, tag := range match.Tags {
+				described = append(described, describeTag(tag))
+			}
+			fmt.Printf("%-9s %s  [%s]\n", match.Type, match.Path, strings.Join(described, ", "))
+		}
+	}
+}
+
+// matchFolders evaluates the expression against the tags stored in the database
+func matchFolders(expr tagexpr.Expr, folders []repository.FolderInfo, aliases tagexpr.Aliases) []queryMatch {
+	matches := []queryMatch{}
+	for _, folder := range folders {
+		tags := aliases.ResolveAll(folder.Tags())
+		if !expr.Matches(tags) {
+			continue
+		}
+
+		folderType, err := getSemlinkType(folder.FullPath)
+		if err != nil || folderType == "" {
+			folderType = "unknown"
+		}
+
+		matches = append(matches, queryMatch{
+			Path:      folder.FullPath,
+			Type:      folderType,
+			Tags:      tags,
+			Inherited: inheritedTags(tags),
+			Device:    folder.Device,
+			Inode:     folder.Inode,
+		})
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Path < matches[j].Path })
+
+	return matches
+}
+
+// inheritedTags lists the ancestors of the tags that are not tags themselves
+func inheritedTags(tags []string) []string {
+	inherited := []string{}
+	for _, tag := range tags {
+		for _, ancestor := range tagexpr.Ancestors(tag) {
+			if !slices.Contains(tags, ancestor) && !slices.Contains(inherited, ancestor) {
+				inherited = append(inherited, ancestor)
+			}
+		}
+	}
+	return inherited
+}
@@ -0,0 +1,581 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"golang.org/x/sys/unix"
+)
+
+// link is a single bind mount of a source folder into a virtual directory inside a receiver.
+type link struct {
+	source   string
+	target   string
+	tag      string
+	virtual  string
+	readOnly bool
+	backend  backendKind
+	lower    []string // union links only, the overlay layers with the top one first
+	upper    string   // union links only, where writes go
+	work     string
+}
+
+// taggedFolder is a registered folder together with its semlink xattr data.
+type taggedFolder struct {
+	path       string
+	folderType Type
+	inode      uint64
+	tags       []string
+	query      tagexpr.Expr // receivers only, replaces matching on tags when set
+	naming     string       // receivers only, template for the virtual directory names
+	layout     layout       // receivers only, whether sources are grouped by tag
+	mode       mountMode    // receivers only, whether sources are mounted read-only
+	backend    backendKind  // receivers only, how sources are linked into it
+	upper      string       // union receivers only, where writes go
+	work       string
+	priority   int // sources only, higher is on top in unions
+}
+
+// mountDiff holds the changes needed to go from the mounted state to the desired state.
+type mountDiff struct {
+	mount   []link
+	unmount []string // one entry per mount that has to be removed, stacked mounts appear multiple times
+	remove  []string // virtual directories that are no longer desired at all
+	record  []link   // correctly mounted links that are missing from the links table
+}
+
+func (diff mountDiff) isEmpty() bool {
+	return len(diff.mount) == 0 && len(diff.unmount) == 0 && len(diff.remove) == 0
+}
+
+// affecting keeps the parts of the diff that involve one of the changed
+// folders: links from or into them, and virtual directories inside them or
+// tracked as a link of one of them.
+func (diff mountDiff) affecting(changed map[string]bool, tracked []repository.LinkInfo) mountDiff {
+	involves := func(paths ...string) bool {
+		for _, p := range paths {
+			for folder := range changed {
+				if p == folder || strings.HasPrefix(p, folder+"/") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	linkInvolves := func(l link) bool {
+		return involves(append([]string{l.source, l.target, l.virtual}, l.lower...)...)
+	}
+
+	var affected mountDiff
+	replaced := make(map[string]bool) // virtual directories that get a new mount
+	for _, l := range diff.mount {
+		if linkInvolves(l) {
+			affected.mount = append(affected.mount, l)
+			replaced[l.virtual] = true
+		}
+	}
+	for _, l := range diff.record {
+		if linkInvolves(l) {
+			affected.record = append(affected.record, l)
+		}
+	}
+
+	byVirtual := make(map[string]repository.LinkInfo)
+	for _, l := range tracked {
+		byVirtual[l.VirtualPath] = l
+	}
+	virtualInvolves := func(virtual string) bool {
+		l := byVirtual[virtual]
+		return replaced[virtual] || involves(append([]string{virtual, l.Source, l.Receiver}, l.Layers...)...)
+	}
+
+	for _, virtual := range diff.unmount {
+		if virtualInvolves(virtual) {
+			affected.unmount = append(affected.unmount, virtual)
+		}
+	}
+	for _, virtual := range diff.remove {
+		if virtualInvolves(virtual) {
+			affected.remove = append(affected.remove, virtual)
+		}
+	}
+
+	return affected
+}
+
+func loadTaggedFolders(repo *repository.SqliteRepo) ([]taggedFolder, error) {
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackBackend, err := globalBackend(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []taggedFolder
+	for _, folder := range folders {
+		if t, ok := loadTaggedFolder(folder, aliases, fallbackBackend); ok {
+			tagged = append(tagged, t)
+		}
+	}
+
+	sort.Slice(tagged, func(i, j int) bool { return tagged[i].path < tagged[j].path })
+
+	return tagged, nil
+}
+
+// loadTaggedFolder reads the semlink xattrs of one registered folder. It
+// returns false when the folder has to be left out, e.g. when it is gone.
+func loadTaggedFolder(folder repository.FolderInfo, aliases tagexpr.Aliases, fallbackBackend backendKind) (taggedFolder, bool) {
+	folderType, err := getSemlinkType(folder.FullPath)
+	if err != nil {
+		if verbose {
+			log.Printf("Could not get type for folder %s: %v", folder.FullPath, err)
+		}
+		return taggedFolder{}, false
+	}
+
+	tags, err := getSemlinkTags(folder.FullPath)
+	if err != nil {
+		if verbose {
+			log.Printf("Could not get tags for folder %s: %v", folder.FullPath, err)
+		}
+		return taggedFolder{}, false
+	}
+
+	var query tagexpr.Expr
+	var naming string
+	var folderLayout layout
+	var mode mountMode
+	var backend backendKind
+	var upper, work string
+	var priority int
+	if Type(folderType) == RECEIVER {
+		query, err = getSemlinkQuery(folder.FullPath)
+		if err != nil {
+			log.Printf("Ignoring receiver %s: %v", folder.FullPath, err)
+			return taggedFolder{}, false
+		}
+		if query != nil {
+			query = aliases.ResolveExpr(query)
+		}
+
+		naming, err = getSemlinkNaming(folder.FullPath)
+		if err != nil {
+			log.Printf("Ignoring receiver %s: %v", folder.FullPath, err)
+			return taggedFolder{}, false
+		}
+
+		folderLayout, err = getSemlinkLayout(folder.FullPath)
+		if err != nil {
+			log.Printf("Ignoring receiver %s: %v", folder.FullPath, err)
+			return taggedFolder{}, false
+		}
+
+		mode, err = getSemlinkMode(folder.FullPath)
+		if err != nil {
+			log.Printf("Ignoring receiver %s: %v", folder.FullPath, err)
+			return taggedFolder{}, false
+		}
+
+		backend, err = getSemlinkBackend(folder.FullPath, fallbackBackend)
+		if err != nil {
+			log.Printf("Ignoring receiver %s: %v", folder.FullPath, err)
+			return taggedFolder{}, false
+		}
+
+		upper, work, err = getSemlinkUpper(folder.FullPath)
+		if err != nil {
+			log.Printf("Ignoring receiver %s: %v", folder.FullPath, err)
+			return taggedFolder{}, false
+		}
+	} else {
+		priority, err = getSemlinkPriority(folder.FullPath)
+		if err != nil {
+			log.Printf("Using priority 0 for %s: %v", folder.FullPath, err)
+		}
+	}
+
+	tags = aliases.ResolveAll(tags)
+
+	return taggedFolder{
+		path:       folder.FullPath,
+		folderType: Type(folderType),
+		inode:      folder.Inode,
+		tags:       tags,
+		query:      query,
+		naming:     naming,
+		layout:     folderLayout,
+		mode:       mode,
+		backend:    backend,
+		upper:      upper,
+		work:       work,
+		priority:   priority,
+	}, true
+}
+
+// desiredLinks joins sources and receivers on their tags, or on the receiver's
+// query when it has one. Every source is mounted once per receiver, even when
+// they share multiple tags. Name conflicts are resolved in source path order
+// and reported in one warning.
+func desiredLinks(folders []taggedFolder) []link {
+	var sources, receivers []taggedFolder
+	for _, folder := range folders {
+		switch folder.folderType {
+		case SOURCE:
+			sources = append(sources, folder)
+		case RECEIVER:
+			receivers = append(receivers, folder)
+		default:
+			log.Printf("Unexpected type encountered for folder %s: %s", folder.path, folder.folderType)
+		}
+	}
+
+	var links []link
+	var conflicts []string
+	claimed := make(map[string]string) // virtual directory -> source
+
+	for _, receiver := range receivers {
+		if receiver.layout == layoutUnion {
+			if receiver.backend == backendSymlink {
+				conflicts = append(conflicts, fmt.Sprintf("%s: skipped, a union needs the %s backend", receiver.path, backendBind))
+				continue
+			}
+
+			l, ok := unionLink(receiver, sources)
+			if !ok {
+				continue
+			}
+			if _, other := claimVirtualPath(claimed, l.virtual, taggedFolder{}); other != "" {
+				conflicts = append(conflicts, fmt.Sprintf("%s: skipped union, it overlaps %s", l.virtual, other))
+				continue
+			}
+			claimed[l.virtual] = l.source
+
+			links = append(links, l)
+			continue
+		}
+
+		for _, source := range sources {
+			tags := receiver.matchingTags(source)
+			if len(tags) == 0 || source.path == receiver.path {
+				continue
+			}
+
+			// only the tagged layout mounts a source once for every tag it matches
+			if receiver.layout != layoutTagged {
+				tags = tags[:1]
+			}
+
+			for _, tag := range tags {
+				wanted := receiver.virtualPath(source, tag)
+				virtual, other := claimVirtualPath(claimed, wanted, source)
+				switch {
+				case virtual == "":
+					conflicts = append(conflicts, fmt.Sprintf("%s: skipped %s, it overlaps %s", wanted, source.path, other))
+					continue
+				case virtual != wanted:
+					conflicts = append(conflicts, fmt.Sprintf("%s: used by %s, mounting %s at %s", wanted, other, source.path, virtual))
+				}
+				claimed[virtual] = source.path
+
+				links = append(links, link{
+					source:   source.path,
+					target:   receiver.path,
+					tag:      tag,
+					virtual:  virtual,
+					readOnly: receiver.mode == modeReadOnly,
+					backend:  receiver.backend,
+				})
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		log.Printf("Virtual directory name conflicts:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+
+	return links
+}
+
+// claimVirtualPath finds a free virtual directory for the source, starting at
+// wanted and appending the source's inode, then a counter, on conflicts.
+// Mounting inside another virtual directory can not be resolved by renaming,
+// in that case it returns an empty path. It also returns the source that held
+// the wanted path.
+func claimVirtualPath(claimed map[string]string, wanted string, source taggedFolder) (string, string) {
+	other, taken := claimed[wanted]
+	if !taken {
+		if nested, ok := overlappingClaim(claimed, wanted); ok {
+			return "", nested
+		}
+		return wanted, ""
+	}
+
+	candidate := fmt.Sprintf("%s-%d", wanted, source.inode)
+	for i := 2; ; i++ {
+		if _, taken := claimed[candidate]; !taken {
+			if _, ok := overlappingClaim(claimed, candidate); !ok {
+				return candidate, other
+			}
+		}
+		candidate = fmt.Sprintf("%s-%d-%d", wanted, source.inode, i)
+	}
+}
+
+// overlappingClaim returns a claimed virtual directory that contains the
+// given one or lives inside it.
+func overlappingClaim(claimed map[string]string, virtual string) (string, bool) {
+	for other, source := range claimed {
+		if strings.HasPrefix(virtual, other+"/") || strings.HasPrefix(other, virtual+"/") {
+			return source, true
+		}
+	}
+	return "", false
+}
+
+// matchingTags returns the tags the receiver wants the source because of, most
+// important first. These are the receiver's own tags or query terms, so a
+// source tagged lang/go lands under lang for a receiver tagged lang and for a
+// receiver with the query lang alike. It returns nothing when the receiver does
+// not want the source.
+func (receiver taggedFolder) matchingTags(source taggedFolder) []string {
+	if receiver.query == nil {
+		return sharedTags(receiver.tags, source.tags)
+	}
+
+	if !receiver.query.Matches(source.tags) {
+		return nil
+	}
+
+	// a query like NOT archived matches without naming any of the source's tags
+	if reasons := tagexpr.Reasons(receiver.query, source.tags); len(reasons) > 0 {
+		return reasons
+	}
+	return []string{""}
+}
+
+// sharedTags returns the receiver tags that cover one of the source's tags, so
+// a receiver tagged lang receives sources tagged lang/go.
+func sharedTags(receiverTags []string, sourceTags []string) []string {
+	var shared []string
+	for _, tag := range receiverTags {
+		if tag == "" {
+			continue
+		}
+		for _, sourceTag := range sourceTags {
+			if tagexpr.Covers(tag, sourceTag) {
+				shared = append(shared, tag)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+func receiverPaths(folders []taggedFolder) []string {
+	var receivers []string
+	for _, folder := range folders {
+		if folder.folderType == RECEIVER {
+			receivers = append(receivers, folder.path)
+		}
+	}
+	return receivers
+}
+
+// ownedMounts counts the mounts managed by semlink: the ones recorded in the
+// links table, and the ones inside a receiver whose mount point is a virtual
+// directory. Other mounts, like a USB drive or sshfs inside a receiver, are
+// never counted.
+func ownedMounts(mounts []mountInfo, receivers []string, tracked map[string]bool, isVirtual func(string) bool) map[string]int {
+	owned := make(map[string]int)
+	for _, mount := range mounts {
+		if tracked[mount.mountPoint] {
+			owned[mount.mountPoint]++
+			continue
+		}
+
+		for _, receiver := range receivers {
+			if strings.HasPrefix(mount.mountPoint, receiver+"/") {
+				if isVirtual(mount.mountPoint) {
+					owned[mount.mountPoint]++
+				}
+				break
+			}
+		}
+	}
+	return owned
+}
+
+func trackedLinks(links []repository.LinkInfo) map[string]bool {
+	tracked := make(map[string]bool)
+	for _, l := range links {
+		tracked[l.VirtualPath] = true
+	}
+	return tracked
+}
+
+// planMounts computes the diff between the owned mounts and the desired links.
+// isMountOf reports whether the mount at a virtual directory shows the link's source.
+func planMounts(desired []link, owned map[string]int, tracked map[string]bool, isMountOf func(link) bool) mountDiff {
+	var diff mountDiff
+
+	wanted := make(map[string]bool)
+	for _, l := range desired {
+		wanted[l.virtual] = true
+
+		count := owned[l.virtual]
+		switch {
+		case count == 0:
+			diff.mount = append(diff.mount, l)
+		case !isMountOf(l):
+			for range count {
+				diff.unmount = append(diff.unmount, l.virtual)
+			}
+			diff.mount = append(diff.mount, l)
+		default:
+			// drop mounts stacked on top of the one we keep
+			for range count - 1 {
+				diff.unmount = append(diff.unmount, l.virtual)
+			}
+			if !tracked[l.virtual] {
+				diff.record = append(diff.record, l)
+			}
+		}
+	}
+
+	var stale []string
+	for mountPoint := range owned {
+		if !wanted[mountPoint] {
+			stale = append(stale, mountPoint)
+		}
+	}
+	for virtual := range tracked {
+		if !wanted[virtual] && owned[virtual] == 0 {
+			stale = append(stale, virtual)
+		}
+	}
+
+	// unmount nested mounts before their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+	for _, mountPoint := range stale {
+		for range owned[mountPoint] {
+			diff.unmount = append(diff.unmount, mountPoint)
+		}
+		diff.remove = append(diff.remove, mountPoint)
+	}
+
+	return diff
+}
+
+func isSameDirectory(a string, b string) bool {
+	var statA, statB unix.Stat_t
+	if err := unix.Stat(a, &statA); err != nil {
+		return false
+	}
+	if err := unix.Stat(b, &statB); err != nil {
+		return false
+	}
+	return statA.Dev == statB.Dev && statA.Ino == statB.Ino
+}
+
+func printMountDiff(diff mountDiff) {
+	if diff.isEmpty() {
+		if verbose {
+			fmt.Println("All mounts are up to date")
+		}
+		return
+	}
+
+	for _, mountPoint := range diff.unmount {
+		fmt.Printf("- %s\n", mountPoint)
+	}
+	for _, l := range diff.mount {
+		fmt.Printf("+ %s -> %s\n", l.source, l.virtual)
+	}
+}
+
+// applyMountDiff performs the diff and, when record is set, keeps the links
+// table in sync with it. Mounts in a private namespace are not recorded, the
+// links table describes the host.
+func applyMountDiff(repo *repository.SqliteRepo, diff mountDiff, record bool) []error {
+	var errs []error
+
+	for _, mountPoint := range diff.unmount {
+		if err := backendAt(mountPoint).unlink(mountPoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, mountPoint := range diff.remove {
+		if err := removeVirtualDirectory(mountPoint); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !record {
+			continue
+		}
+		if err := repo.RemoveLink(mountPoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, l := range diff.mount {
+		status := repository.LinkMounted
+		if err := newLinkBackend(l, nil).link(l); err != nil {
+			errs = append(errs, err)
+			status = repository.LinkFailed
+		}
+
+		if !record {
+			continue
+		}
+		if err := repo.AddLink(l.info(status)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if !record {
+		return errs
+	}
+
+	for _, l := range diff.record {
+		if err := repo.AddLink(l.info(repository.LinkMounted)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func (l link) info(status repository.LinkStatus) repository.LinkInfo {
+	info := repository.LinkInfo{
+		Source:      l.source,
+		Receiver:    l.target,
+		Tag:         l.tag,
+		VirtualPath: l.virtual,
+		MountedAt:   time.Now(),
+		Status:      status,
+	}
+
+	// a union is recorded under its top layer
+	if l.lower != nil {
+		info.Source = l.lower[0]
+		info.Layers = l.lower
+	}
+
+	return info
+}
@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+)
+
+func TestDesiredLinks(t *testing.T) {
+	folders := []taggedFolder{
+		{path: "/src/a/docs", folderType: SOURCE, inode: 12, tags: []string{"work", "go"}},
+		{path: "/src/b/docs", folderType: SOURCE, inode: 34, tags: []string{"work"}},
+		{path: "/src/music", folderType: SOURCE, tags: []string{"fun"}},
+		{path: "/recv/work", folderType: RECEIVER, tags: []string{"go", "work"}},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/a/docs", target: "/recv/work", tag: "go", virtual: "/recv/work/docs"},
+		{source: "/src/b/docs", target: "/recv/work", tag: "work", virtual: "/recv/work/docs-34"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestDesiredLinksWithQuery(t *testing.T) {
+	query, err := tagexpr.Parse("work AND (rust OR go) AND NOT archived")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	folders := []taggedFolder{
+		{path: "/src/api", folderType: SOURCE, tags: []string{"go", "work"}},
+		{path: "/src/cli", folderType: SOURCE, tags: []string{"rust"}},
+		{path: "/src/old", folderType: SOURCE, tags: []string{"rust", "work", "archived"}},
+		{path: "/recv/current", folderType: RECEIVER, tags: []string{"rust"}, query: query},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/api", target: "/recv/current", tag: "work", virtual: "/recv/current/api"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestDesiredLinksWithHierarchicalTags(t *testing.T) {
+	folders := []taggedFolder{
+		{path: "/src/api", folderType: SOURCE, tags: []string{"lang/go"}},
+		{path: "/src/cli", folderType: SOURCE, tags: []string{"lang/rust"}},
+		{path: "/src/notes", folderType: SOURCE, tags: []string{"lang"}},
+		{path: "/recv/code", folderType: RECEIVER, tags: []string{"lang"}},
+		{path: "/recv/go", folderType: RECEIVER, tags: []string{"lang/go"}},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/api", target: "/recv/code", tag: "lang", virtual: "/recv/code/api"},
+		{source: "/src/cli", target: "/recv/code", tag: "lang", virtual: "/recv/code/cli"},
+		{source: "/src/notes", target: "/recv/code", tag: "lang", virtual: "/recv/code/notes"},
+		{source: "/src/api", target: "/recv/go", tag: "lang/go", virtual: "/recv/go/api"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestDesiredLinksWithNamingTemplate(t *testing.T) {
+	folders := []taggedFolder{
+		{path: "/src/a/docs", folderType: SOURCE, inode: 12, tags: []string{"lang/go"}},
+		{path: "/src/b/docs", folderType: SOURCE, inode: 34, tags: []string{"lang/go"}},
+		{path: "/src/c/docs", folderType: SOURCE, inode: 56, tags: []string{"lang/rust"}},
+		{path: "/recv/parent", folderType: RECEIVER, tags: []string{"lang"}, naming: "{parent}_{base}"},
+		{path: "/recv/tag", folderType: RECEIVER, tags: []string{"lang"}, naming: "{tag}/{base}"},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/a/docs", target: "/recv/parent", tag: "lang", virtual: "/recv/parent/a_docs"},
+		{source: "/src/b/docs", target: "/recv/parent", tag: "lang", virtual: "/recv/parent/b_docs"},
+		{source: "/src/c/docs", target: "/recv/parent", tag: "lang", virtual: "/recv/parent/c_docs"},
+		{source: "/src/a/docs", target: "/recv/tag", tag: "lang", virtual: "/recv/tag/lang/docs"},
+		{source: "/src/b/docs", target: "/recv/tag", tag: "lang", virtual: "/recv/tag/lang/docs-34"},
+		{source: "/src/c/docs", target: "/recv/tag", tag: "lang", virtual: "/recv/tag/lang/docs-56"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestDesiredLinksWithLayout(t *testing.T) {
+	folders := []taggedFolder{
+		{path: "/src/api", folderType: SOURCE, tags: []string{"go", "work"}},
+		{path: "/src/notes", folderType: SOURCE, tags: []string{"work"}},
+		{path: "/recv/first", folderType: RECEIVER, tags: []string{"go", "work"}, layout: layoutFirstTag},
+		{path: "/recv/flat", folderType: RECEIVER, tags: []string{"go", "work"}, layout: layoutFlat},
+		{path: "/recv/tagged", folderType: RECEIVER, tags: []string{"go", "work"}, layout: layoutTagged},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/api", target: "/recv/first", tag: "go", virtual: "/recv/first/go/api"},
+		{source: "/src/notes", target: "/recv/first", tag: "work", virtual: "/recv/first/work/notes"},
+		{source: "/src/api", target: "/recv/flat", tag: "go", virtual: "/recv/flat/api"},
+		{source: "/src/notes", target: "/recv/flat", tag: "work", virtual: "/recv/flat/notes"},
+		{source: "/src/api", target: "/recv/tagged", tag: "go", virtual: "/recv/tagged/go/api"},
+		{source: "/src/api", target: "/recv/tagged", tag: "work", virtual: "/recv/tagged/work/api"},
+		{source: "/src/notes", target: "/recv/tagged", tag: "work", virtual: "/recv/tagged/work/notes"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestDesiredLinksWithQueryAndLayout(t *testing.T) {
+	query, err := tagexpr.Parse("rust OR go OR NOT archived")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	folders := []taggedFolder{
+		{path: "/src/api", folderType: SOURCE, tags: []string{"go", "rust"}},
+		{path: "/src/notes", folderType: SOURCE, tags: []string{"text"}},
+		{path: "/recv/code", folderType: RECEIVER, query: query, layout: layoutTagged},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/api", target: "/recv/code", tag: "rust", virtual: "/recv/code/rust/api"},
+		{source: "/src/api", target: "/recv/code", tag: "go", virtual: "/recv/code/go/api"},
+		{source: "/src/notes", target: "/recv/code", tag: "", virtual: "/recv/code/untagged/notes"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestDesiredLinksReadOnly(t *testing.T) {
+	folders := []taggedFolder{
+		{path: "/src/api", folderType: SOURCE, tags: []string{"go"}},
+		{path: "/recv/library", folderType: RECEIVER, tags: []string{"go"}, mode: modeReadOnly},
+		{path: "/recv/work", folderType: RECEIVER, tags: []string{"go"}},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/api", target: "/recv/library", tag: "go", virtual: "/recv/library/api", readOnly: true},
+		{source: "/src/api", target: "/recv/work", tag: "go", virtual: "/recv/work/api"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
+
+func TestClaimVirtualPath(t *testing.T) {
+	claimed := map[string]string{
+		"/recv/docs":      "/src/a/docs",
+		"/recv/docs-7":    "/src/b/docs",
+		"/recv/lang/docs": "/src/c/docs",
+	}
+
+	tests := []struct {
+		wanted  string
+		inode   uint64
+		virtual string
+	}{
+		{"/recv/notes", 7, "/recv/notes"},
+		{"/recv/docs", 9, "/recv/docs-9"},
+		{"/recv/docs", 7, "/recv/docs-7-2"},
+		{"/recv/lang", 9, ""},       // would hide /recv/lang/docs
+		{"/recv/docs/inner", 9, ""}, // would mount inside /recv/docs
+		{"/recv/lang/notes", 9, "/recv/lang/notes"},
+	}
+
+	for _, tt := range tests {
+		virtual, _ := claimVirtualPath(claimed, tt.wanted, taggedFolder{inode: tt.inode})
+		if virtual != tt.virtual {
+			t.Errorf("claimVirtualPath(%s, inode %d) = %q, want %q", tt.wanted, tt.inode, virtual, tt.virtual)
+		}
+	}
+}
+
+func TestOwnedMounts(t *testing.T) {
+	mounts := []mountInfo{
+		{mountPoint: "/"},
+		{mountPoint: "/recv/work/docs"},
+		{mountPoint: "/recv/work/docs"},
+		{mountPoint: "/recv/work/usb"},
+		{mountPoint: "/recv/work/sshfs"},
+		{mountPoint: "/recv/workshop/docs"},
+		{mountPoint: "/elsewhere/docs"},
+	}
+
+	virtual := map[string]bool{"/recv/work/docs": true, "/recv/workshop/docs": true}
+	tracked := map[string]bool{"/elsewhere/docs": true, "/recv/work/sshfs": false}
+
+	owned := ownedMounts(mounts, []string{"/recv/work"}, tracked, func(path string) bool {
+		return virtual[path]
+	})
+
+	// the untracked usb and sshfs mounts inside the receiver are foreign
+	want := map[string]int{"/recv/work/docs": 2, "/elsewhere/docs": 1}
+	if !reflect.DeepEqual(owned, want) {
+		t.Errorf("ownedMounts() = %v, want %v", owned, want)
+	}
+}
+
+func TestPlanMounts(t *testing.T) {
+	fresh := link{source: "/src/fresh", target: "/recv", virtual: "/recv/fresh"}
+	stacked := link{source: "/src/stacked", target: "/recv", virtual: "/recv/stacked"}
+	wrong := link{source: "/src/wrong", target: "/recv", virtual: "/recv/wrong"}
+	kept := link{source: "/src/kept", target: "/recv", virtual: "/recv/kept"}
+
+	owned := map[string]int{
+		"/recv/stacked": 3,
+		"/recv/wrong":   1,
+		"/recv/kept":    1,
+		"/recv/stale":   1,
+	}
+
+	tracked := map[string]bool{"/recv/stacked": true, "/recv/gone": true}
+
+	diff := planMounts([]link{fresh, stacked, wrong, kept}, owned, tracked, func(l link) bool {
+		return l.virtual != "/recv/wrong"
+	})
+
+	wantMount := []link{fresh, wrong}
+	if !reflect.DeepEqual(diff.mount, wantMount) {
+		t.Errorf("mount = %+v, want %+v", diff.mount, wantMount)
+	}
+
+	wantUnmount := []string{"/recv/stacked", "/recv/stacked", "/recv/wrong", "/recv/stale"}
+	if !reflect.DeepEqual(diff.unmount, wantUnmount) {
+		t.Errorf("unmount = %v, want %v", diff.unmount, wantUnmount)
+	}
+
+	wantRemove := []string{"/recv/stale", "/recv/gone"}
+	if !reflect.DeepEqual(diff.remove, wantRemove) {
+		t.Errorf("remove = %v, want %v", diff.remove, wantRemove)
+	}
+
+	wantRecord := []link{kept}
+	if !reflect.DeepEqual(diff.record, wantRecord) {
+		t.Errorf("record = %+v, want %+v", diff.record, wantRecord)
+	}
+
+	// a tag receiver and a query receiver file a source under the same tag
+	query, err := tagexpr.Parse("lang OR lang/*")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	folders := []taggedFolder{
+		{path: "/src/api", folderType: SOURCE, tags: []string{"lang/go/std"}},
+		{path: "/recv/tags", folderType: RECEIVER, tags: []string{"lang"}, layout: layoutFirstTag},
+		{path: "/recv/query", folderType: RECEIVER, query: query, layout: layoutTagged},
+	}
+
+	diff = planMounts(desiredLinks(folders), nil, nil, func(link) bool { return true })
+
+	wantMount = []link{
+		{source: "/src/api", target: "/recv/tags", tag: "lang", virtual: "/recv/tags/lang/api"},
+		{source: "/src/api", target: "/recv/query", tag: "lang", virtual: "/recv/query/lang/api"},
+		{source: "/src/api", target: "/recv/query", tag: "lang/go", virtual: "/recv/query/lang/go/api"},
+	}
+	if !reflect.DeepEqual(diff.mount, wantMount) {
+		t.Errorf("mount for both receiver kinds = %+v, want %+v", diff.mount, wantMount)
+	}
+}
+
+func TestPlanMountsUpToDate(t *testing.T) {
+	kept := link{source: "/src/kept", target: "/recv", virtual: "/recv/kept"}
+
+	diff := planMounts([]link{kept}, map[string]int{"/recv/kept": 1}, map[string]bool{"/recv/kept": true}, func(link) bool { return true })
+	if !diff.isEmpty() {
+		t.Errorf("expected empty diff, got %+v", diff)
+	}
+}
+
+func TestMountDiffAffecting(t *testing.T) {
+	diff := mountDiff{
+		mount: []link{
+			{source: "/src/a", target: "/recv/work", virtual: "/recv/work/a"},
+			{source: "/src/b", target: "/recv/fun", virtual: "/recv/fun/b"},
+			{source: "/src/a:/src/c", target: "/recv/union", virtual: "/recv/union/merged", lower: []string{"/src/a", "/src/c"}},
+		},
+		unmount: []string{"/recv/work/old", "/recv/fun/b", "/recv/fun/c"},
+		remove:  []string{"/recv/work/old", "/recv/fun/c"},
+		record:  []link{{source: "/src/c", target: "/recv/fun", virtual: "/recv/fun/c2"}},
+	}
+
+	tracked := []repository.LinkInfo{
+		{Source: "/src/c", Receiver: "/recv/fun", VirtualPath: "/recv/fun/c"},
+		{Source: "/src/a", Receiver: "/recv/fun", VirtualPath: "/recv/fun/b"},
+	}
+
+	got := diff.affecting(map[string]bool{"/src/a": true}, tracked)
+
+	want := mountDiff{
+		mount: []link{
+			{source: "/src/a", target: "/recv/work", virtual: "/recv/work/a"},
+			{source: "/src/a:/src/c", target: "/recv/union", virtual: "/recv/union/merged", lower: []string{"/src/a", "/src/c"}},
+		},
+		unmount: []string{"/recv/fun/b"}, // tracked as a link of /src/a
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("affecting /src/a = %+v, want %+v", got, want)
+	}
+
+	// a changed receiver takes everything inside it
+	got = diff.affecting(map[string]bool{"/recv/fun": true}, tracked)
+	if len(got.mount) != 1 || len(got.unmount) != 2 || len(got.remove) != 1 || len(got.record) != 1 {
+		t.Errorf("affecting /recv/fun = %+v, want everything inside the receiver", got)
+	}
+
+	if got := diff.affecting(map[string]bool{"/src/other": true}, tracked); !got.isEmpty() || len(got.record) != 0 {
+		t.Errorf("affecting an unrelated folder = %+v, want nothing", got)
+	}
+}
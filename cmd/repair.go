@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	repairRoots []string
+	pruneFlag   bool
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Find moved and deleted folders",
+	Long: `Check every registered folder. Folders that are no longer at their stored path are
+searched for in the given roots by device and inode, and only accepted when they
+still carry semlink xattr data. Folders that can not be found are reported, or
+removed from the database with --prune.`,
+	Args: cobra.NoArgs,
+	Run:  runRepair,
+}
+
+func init() {
+	repairCmd.Flags().StringSliceVarP(&repairRoots, "root", "r", []string{}, "Directories to search for moved folders (default: your home directory)")
+	repairCmd.Flags().BoolVarP(&pruneFlag, "prune", "p", false, "Remove folders that can not be found from the database")
+	repairCmd.Flags().BoolVarP(&dryRunFlag, "dry-run", "n", false, "Only print what would be repaired")
+
+	rootCmd.AddCommand(repairCmd)
+}
+
+// fileID identifies a directory independently of its path
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+func runRepair(cmd *cobra.Command, args []string) {
+	if !dryRunFlag {
+		ensureIsPrivileged()
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	roots := repairRoots
+	if len(roots) == 0 {
+		roots = []string{repository.HomeDir()}
+	}
+
+	orphans := findOrphans(folders)
+	if len(orphans) == 0 {
+		fmt.Println("All folders are in place")
+		return
+	}
+
+	skip, err := virtualDirectories(repo, folders)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	found := searchRoots(roots, orphans, skip)
+
+	changed := false
+	for _, orphan := range orphans {
+		id := fileID{device: orphan.Device, inode: orphan.Inode}
+		newPath, ok := found[id]
+
+		switch {
+		case ok:
+			moved, err := statFolder(newPath)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("moved:   %s -> %s\n", orphan.FullPath, newPath)
+			if dryRunFlag {
+				continue
+			}
+
+			if err := repo.UpdateFolder(orphan, moved); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			changed = true
+
+		case pruneFlag:
+			fmt.Printf("pruned:  %s\n", orphan.FullPath)
+			if dryRunFlag {
+				continue
+			}
+
+			if err := repo.RemoveFolder(orphan); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			changed = true
+
+		default:
+			fmt.Printf("missing: %s\n", orphan.FullPath)
+		}
+	}
+
+	if changed {
+		triggerUpdate()
+	}
+}
+
+// findOrphans returns the folders that are no longer found at their stored path.
+// Folders without a known device (from before devices were stored) are only
+// orphaned when their inode changed.
+func findOrphans(folders []repository.FolderInfo) []repository.FolderInfo {
+	var orphans []repository.FolderInfo
+	for _, folder := range folders {
+		var stat unix.Stat_t
+		if err := unix.Stat(folder.FullPath, &stat); err != nil {
+			orphans = append(orphans, folder)
+			continue
+		}
+
+		sameDevice := folder.Device == 0 || folder.Device == uint64(stat.Dev)
+		if !sameDevice || folder.Inode != stat.Ino {
+			orphans = append(orphans, folder)
+		}
+	}
+	return orphans
+}
+
+// virtualDirectories lists the mounted virtual directories. A bind mount shows
+// the device and inode of its source, so the search must not descend into them.
+func virtualDirectories(repo *repository.SqliteRepo, folders []repository.FolderInfo) (map[string]bool, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	var receivers []string
+	for _, folder := range folders {
+		if folderType, err := getSemlinkType(folder.FullPath); err == nil && Type(folderType) == RECEIVER {
+			receivers = append(receivers, folder.FullPath)
+		}
+	}
+
+	skip := make(map[string]bool)
+	for mountPoint := range ownedMounts(mounts, receivers, trackedLinks(links), isVirtualDirectory) {
+		skip[mountPoint] = true
+	}
+	return skip, nil
+}
+
+// searchRoots walks the roots looking for the orphaned folders. A directory only
+// matches when it still carries a semlink type, so a reused inode is not mistaken
+// for the folder.
+func searchRoots(roots []string, orphans []repository.FolderInfo, skip map[string]bool) map[fileID]string {
+	wanted := make(map[fileID]bool)
+	unknownDevice := make(map[uint64]bool) // inodes of orphans without a stored device
+	for _, orphan := range orphans {
+		if orphan.Device == 0 {
+			unknownDevice[orphan.Inode] = true
+		} else {
+			wanted[fileID{device: orphan.Device, inode: orphan.Inode}] = true
+		}
+	}
+
+	found := make(map[fileID]string)
+	for _, root := range roots {
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if verbose {
+					log.Printf("Skipping %s: %v", path, err)
+				}
+				return nil
+			}
+
+			if !entry.IsDir() {
+				return nil
+			}
+
+			if skip[path] {
+				return filepath.SkipDir
+			}
+
+			var stat unix.Stat_t
+			if err := unix.Lstat(path, &stat); err != nil {
+				return nil
+			}
+
+			id := fileID{device: uint64(stat.Dev), inode: stat.Ino}
+			if !wanted[id] && !unknownDevice[id.inode] {
+				return nil
+			}
+
+			if folderType, err := getSemlinkType(path); err != nil || folderType == "" {
+				return nil
+			}
+
+			if wanted[id] {
+				found[id] = path
+			} else {
+				found[fileID{inode: id.inode}] = path
+			}
+
+			return nil
+		})
+	}
+
+	return found
+}
+
+// warnAboutOrphans points the user to the repair command when folders went missing.
+func warnAboutOrphans(repo *repository.SqliteRepo) {
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		return
+	}
+
+	if orphans := findOrphans(folders); len(orphans) > 0 {
+		fmt.Printf("%d registered folder(s) are no longer at their stored path, run 'semlink repair'\n", len(orphans))
+	}
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+)
+
+func TestFindOrphans(t *testing.T) {
+	present := t.TempDir()
+	folder, err := statFolder(present)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	withoutDevice := folder
+	withoutDevice.Device = 0
+
+	replaced := folder
+	replaced.Inode++
+
+	gone := repository.FolderInfo{Device: folder.Device, Inode: folder.Inode, FullPath: "/does/not/exist"}
+
+	orphans := findOrphans([]repository.FolderInfo{folder, withoutDevice, replaced, gone})
+
+	if len(orphans) != 2 || orphans[0].Inode != replaced.Inode || orphans[1].FullPath != gone.FullPath {
+		t.Errorf("findOrphans() = %+v, want %+v and %+v", orphans, replaced, gone)
+	}
+}
+
+func TestSearchRoots(t *testing.T) {
+	root := t.TempDir()
+
+	original := filepath.Join(root, "projects")
+	if err := os.Mkdir(original, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := setType(original, SOURCE); err != nil {
+		t.Fatalf("Failed to set type: %v", err)
+	}
+
+	folder, err := statFolder(original)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	unmarked := filepath.Join(root, "unmarked")
+	if err := os.Mkdir(unmarked, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	unmarkedFolder, err := statFolder(unmarked)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	moved := filepath.Join(root, "archive", "projects")
+	if err := os.Mkdir(filepath.Join(root, "archive"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Rename(original, moved); err != nil {
+		t.Fatalf("Failed to move directory: %v", err)
+	}
+
+	unmarkedFolder.FullPath = "/elsewhere"
+	found := searchRoots([]string{root}, []repository.FolderInfo{folder, unmarkedFolder}, nil)
+
+	id := fileID{device: folder.Device, inode: folder.Inode}
+	if found[id] != moved {
+		t.Errorf("found %q for moved folder, want %q", found[id], moved)
+	}
+
+	if path, ok := found[fileID{device: unmarkedFolder.Device, inode: unmarkedFolder.Inode}]; ok {
+		t.Errorf("directory without semlink data was accepted: %s", path)
+	}
+
+	skipped := searchRoots([]string{root}, []repository.FolderInfo{folder}, map[string]bool{filepath.Join(root, "archive"): true})
+	if len(skipped) != 0 {
+		t.Errorf("search descended into a skipped directory: %v", skipped)
+	}
+}
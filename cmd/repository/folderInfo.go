@@ -1,7 +1,14 @@
 package repository
 
+// FolderInfo identifies a folder by device and inode, since inodes are only unique per filesystem
 type FolderInfo struct {
+	Device   uint64 `json:"device"`
 	Inode    uint64 `json:"inode"`
 	FullPath string `json:"full_path"`
 	tags     []string
 }
+
+// Tags returns the tags stored for the folder in the database
+func (folder FolderInfo) Tags() []string {
+	return folder.tags
+}
@@ -0,0 +1,21 @@
+package repository
+
+import "time"
+
+type LinkStatus string
+
+const (
+	LinkMounted LinkStatus = "mounted"
+	LinkFailed  LinkStatus = "failed"
+)
+
+// LinkInfo records a virtual directory that was mounted for a source inside a receiver
+type LinkInfo struct {
+	Source      string     `json:"source"`
+	Receiver    string     `json:"receiver"`
+	Tag         string     `json:"tag"`
+	VirtualPath string     `json:"virtual_path"`
+	MountedAt   time.Time  `json:"mounted_at"`
+	Status      LinkStatus `json:"status"`
+	Layers      []string   `json:"layers,omitempty"` // union links only, the merged sources with the top one first
+}
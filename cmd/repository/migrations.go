@@ -0,0 +1,339 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"golang.org/x/sys/unix"
+)
+
+// migration upgrades the schema by one version. The schema version is stored
+// in PRAGMA user_version, databases from before versioning have version 0.
+// Migrations run with foreign keys disabled, so tables can be rebuilt without
+// cascading deletes.
+type migration struct {
+	version     int
+	description string
+	statements  string
+	backfill    func(tx *sql.Tx) error // optional, runs after the statements
+}
+
+// migrations must only ever be appended to, never edited: users have
+// databases on every version.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create folders, tags and folder_tags",
+		statements: `
+CREATE TABLE IF NOT EXISTS folders (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    inode INTEGER NOT NULL UNIQUE,
+    filepath TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS folder_tags (
+    folder_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (folder_id, tag_id),
+    FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+`,
+	},
+	{
+		version:     2,
+		description: "create links",
+		statements: `
+CREATE TABLE IF NOT EXISTS links (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    source_folder_id INTEGER NOT NULL,
+    receiver_folder_id INTEGER NOT NULL,
+    tag_id INTEGER,
+    virtual_path TEXT NOT NULL UNIQUE,
+    mounted_at TIMESTAMP NOT NULL,
+    status TEXT NOT NULL,
+    FOREIGN KEY (source_folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+    FOREIGN KEY (receiver_folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE SET NULL
+);
+`,
+	},
+	{
+		version:     3,
+		description: "identify folders by device and inode",
+		statements: `
+CREATE TABLE folders_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device INTEGER NOT NULL DEFAULT 0,
+    inode INTEGER NOT NULL,
+    filepath TEXT NOT NULL UNIQUE,
+    UNIQUE (device, inode)
+);
+
+INSERT INTO folders_new (id, device, inode, filepath) SELECT id, 0, inode, filepath FROM folders;
+DROP TABLE folders;
+ALTER TABLE folders_new RENAME TO folders;
+`,
+		backfill: backfillFolderDevices,
+	},
+	{
+		version:     4,
+		description: "add parent relation to hierarchical tags",
+		statements: `
+ALTER TABLE tags ADD COLUMN parent_id INTEGER REFERENCES tags(id) ON DELETE SET NULL;
+`,
+		backfill: backfillTagParents,
+	},
+	{
+		version:     5,
+		description: "create tag_aliases",
+		statements: `
+CREATE TABLE IF NOT EXISTS tag_aliases (
+    alias TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+    canonical TEXT NOT NULL
+);
+`,
+	},
+	{
+		version:     6,
+		description: "create tag_operations",
+		statements: `
+CREATE TABLE IF NOT EXISTS tag_operations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    from_tags TEXT NOT NULL,
+    to_tag TEXT NOT NULL,
+    started_at TIMESTAMP NOT NULL
+);
+`,
+	},
+	{
+		version:     7,
+		description: "create settings",
+		statements: `
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+`,
+	},
+	{
+		version:     8,
+		description: "create link_layers",
+		statements: `
+CREATE TABLE IF NOT EXISTS link_layers (
+    link_id INTEGER NOT NULL,
+    folder_id INTEGER NOT NULL,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (link_id, position),
+    FOREIGN KEY (link_id) REFERENCES links(id) ON DELETE CASCADE,
+    FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+);
+`,
+	},
+}
+
+// backfillTagParents creates the missing ancestors of existing hierarchical tags
+// and links every tag to its parent.
+func backfillTagParents(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT name FROM tags WHERE name LIKE '%/%'`)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		for child, parent := name, tagexpr.Parent(name); parent != ""; child, parent = parent, tagexpr.Parent(parent) {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO tags (name) VALUES (?)`, parent); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE tags SET parent_id = (SELECT id FROM tags WHERE name = ?) WHERE name = ?`, parent, child); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// backfillFolderDevices fills in the device of folders that still exist at
+// their stored path with the stored inode. Others keep device 0 until repaired.
+func backfillFolderDevices(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, inode, filepath FROM folders`)
+	if err != nil {
+		return err
+	}
+
+	type folderDevice struct {
+		id     int64
+		device uint64
+	}
+
+	var found []folderDevice
+	for rows.Next() {
+		var id, inode int64
+		var path string
+		if err := rows.Scan(&id, &inode, &path); err != nil {
+			rows.Close()
+			return err
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Stat(path, &stat); err != nil || stat.Ino != uint64(inode) {
+			continue
+		}
+
+		found = append(found, folderDevice{id: id, device: uint64(stat.Dev)})
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range found {
+		if _, err := tx.Exec(`UPDATE folders SET device = ? WHERE id = ?`, f.device, f.id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrationInfo describes a migration and whether the database already has it
+type MigrationInfo struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies all pending migrations, each in its own transaction, and
+// returns the ones that were applied.
+func migrate(db *sql.DB) ([]MigrationInfo, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if version > latestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this semlink supports (%d)", version, latestSchemaVersion())
+	}
+
+	var applied []MigrationInfo
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if err := applyMigration(db, m); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, MigrationInfo{Version: m.version, Description: m.description, Applied: true})
+	}
+
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.statements); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+	}
+
+	if m.backfill != nil {
+		if err := m.backfill(tx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+
+	// PRAGMA does not support placeholders
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+		return fmt.Errorf("failed to set schema version to %d: %w", m.version, err)
+	}
+
+	return tx.Commit()
+}
+
+// Migrate brings the database up to date and returns the migrations that were applied.
+func Migrate() ([]MigrationInfo, error) {
+	dbPath := getDBPath()
+	if err := os.MkdirAll(dbPath, 0775); err != nil {
+		return nil, fmt.Errorf("could not create directory for database: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dbPath, databaseFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return migrate(db)
+}
+
+// MigrationStatus lists every migration and whether it has been applied,
+// without changing the database.
+func MigrationStatus() ([]MigrationInfo, error) {
+	version := 0
+
+	dbFilePath := filepath.Join(getDBPath(), databaseFilename)
+	if _, err := os.Stat(dbFilePath); err == nil {
+		db, err := sql.Open("sqlite3", "file:"+dbFilePath+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		version, err = schemaVersion(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var status []MigrationInfo
+	for _, m := range migrations {
+		status = append(status, MigrationInfo{Version: m.version, Description: m.description, Applied: m.version <= version})
+	}
+
+	return status, nil
+}
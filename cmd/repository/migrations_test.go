@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// legacySchema is the schema semlink created before databases were versioned.
+const legacySchema = `
+CREATE TABLE IF NOT EXISTS folders (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    inode INTEGER NOT NULL UNIQUE,
+    filepath TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS folder_tags (
+    folder_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (folder_id, tag_id),
+    FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+`
+
+const fixtureData = `
+INSERT INTO folders (inode, filepath) VALUES (42, '/home/user/projects');
+INSERT INTO tags (name) VALUES ('work');
+INSERT INTO folder_tags (folder_id, tag_id) VALUES (1, 1);
+`
+
+func openFixture(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), databaseFilename))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func assertUpgraded(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("schema version = %d, want %d", version, latestSchemaVersion())
+	}
+
+	var path, tag string
+	err = db.QueryRow(`
+		SELECT f.filepath, t.name
+		FROM folders f
+		JOIN folder_tags ft ON f.id = ft.folder_id
+		JOIN tags t ON ft.tag_id = t.id`).Scan(&path, &tag)
+	if err != nil {
+		t.Fatalf("fixture data lost during migration: %v", err)
+	}
+	if path != "/home/user/projects" || tag != "work" {
+		t.Errorf("fixture data = %s %s, want /home/user/projects work", path, tag)
+	}
+}
+
+func TestMigrateFromLegacySchema(t *testing.T) {
+	db := openFixture(t)
+
+	if _, err := db.Exec(legacySchema + fixtureData); err != nil {
+		t.Fatalf("failed to create fixture: %v", err)
+	}
+
+	if _, err := migrate(db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	assertUpgraded(t, db)
+}
+
+func TestMigrateBackfillsDevices(t *testing.T) {
+	db := openFixture(t)
+
+	existing := t.TempDir()
+	var stat unix.Stat_t
+	if err := unix.Stat(existing, &stat); err != nil {
+		t.Fatalf("failed to stat %s: %v", existing, err)
+	}
+
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatalf("failed to create fixture: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO folders (inode, filepath) VALUES (?, ?), (?, '/does/not/exist')`, stat.Ino, existing, stat.Ino+1); err != nil {
+		t.Fatalf("failed to insert fixture data: %v", err)
+	}
+
+	if _, err := migrate(db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	var device uint64
+	if err := db.QueryRow(`SELECT device FROM folders WHERE filepath = ?`, existing).Scan(&device); err != nil {
+		t.Fatalf("failed to read device: %v", err)
+	}
+	if device != uint64(stat.Dev) {
+		t.Errorf("device = %d, want %d", device, stat.Dev)
+	}
+
+	if err := db.QueryRow(`SELECT device FROM folders WHERE filepath = '/does/not/exist'`).Scan(&device); err != nil {
+		t.Fatalf("failed to read device: %v", err)
+	}
+	if device != 0 {
+		t.Errorf("device of a missing folder = %d, want 0", device)
+	}
+}
+
+func TestMigrateBackfillsTagParents(t *testing.T) {
+	db := openFixture(t)
+
+	if _, err := db.Exec(legacySchema + `INSERT INTO tags (name) VALUES ('lang/go/std'), ('lang')`); err != nil {
+		t.Fatalf("failed to create fixture: %v", err)
+	}
+
+	if _, err := migrate(db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT t.name, COALESCE(p.name, '')
+		FROM tags t LEFT JOIN tags p ON t.parent_id = p.id
+		ORDER BY t.name`)
+	if err != nil {
+		t.Fatalf("failed to query tags: %v", err)
+	}
+	defer rows.Close()
+
+	parents := make(map[string]string)
+	for rows.Next() {
+		var name, parent string
+		if err := rows.Scan(&name, &parent); err != nil {
+			t.Fatalf("failed to scan tag: %v", err)
+		}
+		parents[name] = parent
+	}
+
+	want := map[string]string{"lang": "", "lang/go": "lang", "lang/go/std": "lang/go"}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("tag parents = %v, want %v", parents, want)
+	}
+}
+
+func TestMigrateFromEveryVersion(t *testing.T) {
+	for i := range migrations[:len(migrations)-1] {
+		from := migrations[i]
+
+		t.Run(from.description, func(t *testing.T) {
+			db := openFixture(t)
+
+			for _, m := range migrations[:i+1] {
+				if err := applyMigration(db, m); err != nil {
+					t.Fatalf("failed to create fixture at version %d: %v", from.version, err)
+				}
+			}
+
+			if _, err := db.Exec(fixtureData); err != nil {
+				t.Fatalf("failed to insert fixture data: %v", err)
+			}
+
+			applied, err := migrate(db)
+			if err != nil {
+				t.Fatalf("migrate failed: %v", err)
+			}
+			if len(applied) != len(migrations)-i-1 {
+				t.Errorf("applied %d migrations, want %d", len(applied), len(migrations)-i-1)
+			}
+
+			assertUpgraded(t, db)
+		})
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := openFixture(t)
+
+	if _, err := migrate(db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	applied, err := migrate(db)
+	if err != nil {
+		t.Fatalf("second migrate failed: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("expected no migrations on an up to date database, got %v", applied)
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	db := openFixture(t)
+
+	if _, err := db.Exec(`PRAGMA user_version = 9999`); err != nil {
+		t.Fatalf("failed to set version: %v", err)
+	}
+
+	if _, err := migrate(db); err == nil {
+		t.Error("expected error for a database from a newer semlink")
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	status, err := MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	for _, m := range status {
+		if m.Applied {
+			t.Errorf("migration %d reported as applied on a missing database", m.Version)
+		}
+	}
+
+	if _, err := Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	status, err = MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	for _, m := range status {
+		if !m.Applied {
+			t.Errorf("migration %d reported as pending after Migrate", m.Version)
+		}
+	}
+}
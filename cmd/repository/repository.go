@@ -2,13 +2,18 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"os/user"
 
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -16,7 +21,9 @@ const (
 	databaseFilename  = "semlink.sqlite"
 )
 
-func getDBPath() string {
+// HomeDir returns the home directory of the user running semlink, also when
+// running through sudo.
+func HomeDir() string {
 	var home string
 
 	// If running with sudo, resolve SUDO_USER's home directory
@@ -37,10 +44,19 @@ func getDBPath() string {
 		os.Exit(1)
 	}
 
-	dbPath := filepath.Join(home, databaseDirectory)
+	return home
+}
+
+func getDBPath() string {
+	dbPath := filepath.Join(HomeDir(), databaseDirectory)
 	return dbPath
 }
 
+// DatabaseFile returns the path of the database file
+func DatabaseFile() string {
+	return filepath.Join(getDBPath(), databaseFilename)
+}
+
 func getDatabaseConnection() (*sql.DB, error) {
 	dbPath := getDBPath()
 	err := ensureDB(dbPath)
@@ -50,7 +66,7 @@ func getDatabaseConnection() (*sql.DB, error) {
 
 	// Join the database filename to the path
 	dbFilePath := filepath.Join(dbPath, databaseFilename)
-	db, err := sql.Open("sqlite3", dbFilePath)
+	db, err := sql.Open("sqlite3", dbFilePath+"?_foreign_keys=on")
 	if err != nil {
 		fmt.Printf("getDatabaseConnection(): Could not open database at %s\n", dbFilePath)
 		return nil, err
@@ -63,7 +79,22 @@ type repository interface {
 	GetAllFolders() ([]FolderInfo, error)
 	AddFolder(FolderInfo) error
 	RemoveFolder(FolderInfo) error
+	UpdateFolder(old FolderInfo, updated FolderInfo) error
 	AddTagsToFolder(FolderInfo, []string) error
+	RemoveTagsFromFolder(FolderInfo, []string) error
+	GetAliases() (tagexpr.Aliases, error)
+	AddAlias(alias string, canonical string) error
+	RemoveAlias(alias string) error
+	RedirectAliases(from string, to string) error
+	StartTagOperation(TagOperation) (int64, error)
+	PendingTagOperations() ([]TagOperation, error)
+	FinishTagOperation(id int64) error
+	GetAllLinks() ([]LinkInfo, error)
+	AddLink(LinkInfo) error
+	RemoveLink(virtualPath string) error
+	GetSetting(key string) (string, error)
+	SetSetting(key string, value string) error
+	RemoveSetting(key string) error
 	Obliterate() error /* completely wipes the database */
 }
 
@@ -83,6 +114,8 @@ func NewSqliteRepo() (*SqliteRepo, error) {
 func (repo *SqliteRepo) GetAllFolders() ([]FolderInfo, error) {
 	query := `
 		SELECT 
+			f.id,
+			f.device,
 			f.inode, 
 			f.filepath, 
 			t.name 
@@ -98,26 +131,26 @@ func (repo *SqliteRepo) GetAllFolders() ([]FolderInfo, error) {
 	}
 	defer rows.Close()
 
-	foldersMap := make(map[uint64]*FolderInfo)
+	foldersMap := make(map[int64]*FolderInfo)
 
 	for rows.Next() {
-		var inode int64
+		var id, device, inode int64
 		var path string
 		var tag sql.NullString
 
-		if err := rows.Scan(&inode, &path, &tag); err != nil {
+		if err := rows.Scan(&id, &device, &inode, &path, &tag); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		uid := uint64(inode)
-		folder, exists := foldersMap[uid]
+		folder, exists := foldersMap[id]
 		if !exists {
 			folder = &FolderInfo{
-				Inode:    uid,
+				Device:   uint64(device),
+				Inode:    uint64(inode),
 				FullPath: path,
 				tags:     []string{},
 			}
-			foldersMap[uid] = folder
+			foldersMap[id] = folder
 		}
 
 		if tag.Valid {
@@ -133,36 +166,113 @@ func (repo *SqliteRepo) GetAllFolders() ([]FolderInfo, error) {
 	return result, nil
 }
 
+// ErrFolderNotFound is returned when no stored folder matches
+var ErrFolderNotFound = errors.New("folder not found")
+
+// AddFolder registers a folder. A folder that is already known by its device
+// and inode gets its new path, a new folder at a known path takes over the
+// old record.
 func (folderRepo *SqliteRepo) AddFolder(folderInfo FolderInfo) error {
 
-	query := `INSERT INTO folders (inode, filepath) VALUES (?, ?)`
+	query := `
+		INSERT INTO folders (device, inode, filepath) VALUES (?, ?, ?)
+		ON CONFLICT (device, inode) DO UPDATE SET filepath = excluded.filepath
+		ON CONFLICT (filepath) DO UPDATE SET device = excluded.device, inode = excluded.inode`
 
-	_, err := folderRepo.conn.Exec(query, folderInfo.Inode, folderInfo.FullPath)
+	_, err := folderRepo.conn.Exec(query, folderInfo.Device, folderInfo.Inode, folderInfo.FullPath)
 	return err
 }
 
+// RemoveFolder removes a folder by its device and inode. A folder migrated
+// without a device is matched by inode and path instead.
 func (repo *SqliteRepo) RemoveFolder(folderInfo FolderInfo) error {
 
-	// TODO: remove also tags in folder_tags.
+	// folder_tags and links rows are removed by ON DELETE CASCADE
+	stmt := `DELETE FROM folders WHERE inode = ? AND (device = ? OR (device = 0 AND filepath = ?))`
+	result, err := repo.conn.Exec(stmt, folderInfo.Inode, folderInfo.Device, folderInfo.FullPath)
+	if err != nil {
+		return err
+	}
 
-	stmt := `DELETE FROM folders WHERE inode = ?`
-	_, err := repo.conn.Exec(stmt, folderInfo.Inode)
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%s: %w", folderInfo.FullPath, ErrFolderNotFound)
+	}
 
-	return err
+	return nil
 }
 
-func (repo *SqliteRepo) HasFolder(folderInfo FolderInfo) (bool, error) {
-	query := `SELECT * FROM folders WHERE inode = ? && filepath = ?`
+// lookupFolder finds a folder by its device and inode, so it is still found
+// after it moved, and stores its current path. A folder migrated without a
+// device is matched by inode and path, and gets its device.
+func lookupFolder(tx *sql.Tx, folderInfo FolderInfo) (int64, error) {
+	var id int64
+	var device uint64
+	var path string
+
+	err := tx.QueryRow(`
+		SELECT id, device, filepath FROM folders
+		WHERE inode = ? AND (device = ? OR (device = 0 AND filepath = ?))
+		ORDER BY device DESC LIMIT 1`,
+		folderInfo.Inode, folderInfo.Device, folderInfo.FullPath).Scan(&id, &device, &path)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s: %w", folderInfo.FullPath, ErrFolderNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up folder %s: %w", folderInfo.FullPath, err)
+	}
+
+	if folderInfo.Device != 0 && (device != folderInfo.Device || path != folderInfo.FullPath) {
+		_, err := tx.Exec(`UPDATE folders SET device = ?, filepath = ? WHERE id = ?`, folderInfo.Device, folderInfo.FullPath, id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update the path of %s: %w", folderInfo.FullPath, err)
+		}
+	}
 
-	folder := folderInfo
+	return id, nil
+}
 
-	if err := repo.conn.QueryRow(query, folderInfo.Inode, folderInfo.FullPath).Scan(&folder); err == nil {
-		return false, nil
-	} else if err == sql.ErrNoRows {
-		return true, nil
-	} else {
+// lookupFolderAt finds the folder at a path by its device and inode. A path
+// that can not be read is looked up as stored.
+func lookupFolderAt(tx *sql.Tx, path string) (int64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err == nil {
+		return lookupFolder(tx, FolderInfo{Device: uint64(stat.Dev), Inode: stat.Ino, FullPath: path})
+	}
+
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM folders WHERE filepath = ?`, path).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("%s: %w", path, ErrFolderNotFound)
+	}
+	return id, err
+}
+
+// UpdateFolder changes the identity and path of a folder, e.g. after it was moved.
+func (repo *SqliteRepo) UpdateFolder(old FolderInfo, updated FolderInfo) error {
+	stmt := `UPDATE folders SET device = ?, inode = ?, filepath = ? WHERE device = ? AND inode = ?`
+
+	result, err := repo.conn.Exec(stmt, updated.Device, updated.Inode, updated.FullPath, old.Device, old.Inode)
+	if err != nil {
+		return fmt.Errorf("failed to update folder %s: %w", old.FullPath, err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("folder %s not found", old.FullPath)
+	}
+
+	return nil
+}
+
+// HasFolder reports whether the folder is registered, wherever it is now
+func (repo *SqliteRepo) HasFolder(folderInfo FolderInfo) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 FROM folders WHERE inode = ? AND (device = ? OR (device = 0 AND filepath = ?)))`
+
+	var exists bool
+	if err := repo.conn.QueryRow(query, folderInfo.Inode, folderInfo.Device, folderInfo.FullPath).Scan(&exists); err != nil {
 		return false, err
 	}
+
+	return exists, nil
 }
 
 func (repo *SqliteRepo) AddTagsToFolder(folderInfo FolderInfo, tags []string) error {
@@ -174,22 +284,15 @@ func (repo *SqliteRepo) AddTagsToFolder(folderInfo FolderInfo, tags []string) er
 	// Ensures that all operations are done atomically. If one fails, we can roll everything back:
 	defer tx.Rollback()
 
-	var folderID int
-	err = tx.QueryRow(`SELECT id FROM folders WHERE filepath = ?`, folderInfo.FullPath).Scan(&folderID)
+	folderID, err := lookupFolder(tx, folderInfo)
 	if err != nil {
-		return fmt.Errorf("folder not found: %w", err)
+		return err
 	}
 
 	for _, tagName := range tags {
-		_, err := tx.Exec(`INSERT OR IGNORE INTO tags (name) VALUES (?)`, tagName)
+		tagID, err := ensureTag(tx, tagName)
 		if err != nil {
-			return fmt.Errorf("failed to insert tag: %w", err)
-		}
-
-		var tagID int
-		err = tx.QueryRow(`SELECT id FROM tags WHERE name = ?`, tagName).Scan(&tagID)
-		if err != nil {
-			return fmt.Errorf("failed to retrieve tag id: %w", err)
+			return err
 		}
 
 		_, err = tx.Exec(`INSERT OR IGNORE INTO folder_tags (folder_id, tag_id) VALUES (?, ?)`, folderID, tagID)
@@ -201,7 +304,55 @@ func (repo *SqliteRepo) AddTagsToFolder(folderInfo FolderInfo, tags []string) er
 	return tx.Commit()
 }
 
-// TODO: implement
+// ensureTag inserts a tag and its ancestors when they do not exist yet, and
+// returns the tag's id.
+func ensureTag(tx *sql.Tx, tagName string) (int64, error) {
+	var parentID sql.NullInt64
+	if parent := tagexpr.Parent(tagName); parent != "" {
+		id, err := ensureTag(tx, parent)
+		if err != nil {
+			return 0, err
+		}
+		parentID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO tags (name, parent_id) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET parent_id = excluded.parent_id`, tagName, parentID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert tag: %w", err)
+	}
+
+	var tagID int64
+	err = tx.QueryRow(`SELECT id FROM tags WHERE name = ?`, tagName).Scan(&tagID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve tag id: %w", err)
+	}
+
+	return tagID, nil
+}
+
+// removeOrphanedTags removes tags that no folder uses and that are not the
+// parent of a tag that is still in use.
+func removeOrphanedTags(tx *sql.Tx) error {
+	for {
+		result, err := tx.Exec(`
+			DELETE FROM tags
+			WHERE id NOT IN (SELECT tag_id FROM folder_tags)
+			AND id NOT IN (SELECT parent_id FROM tags WHERE parent_id IS NOT NULL)`)
+		if err != nil {
+			return fmt.Errorf("failed to remove orphaned tags: %w", err)
+		}
+
+		// removing a leaf can orphan its parent
+		if removed, err := result.RowsAffected(); err != nil || removed == 0 {
+			return err
+		}
+	}
+}
+
+// RemoveTagsFromFolder unlinks the given tags from a folder and removes tags
+// that are no longer used by any folder.
 func (repo *SqliteRepo) RemoveTagsFromFolder(folderInfo FolderInfo, tags []string) error {
 	tx, err := repo.conn.Begin()
 	if err != nil {
@@ -210,9 +361,325 @@ func (repo *SqliteRepo) RemoveTagsFromFolder(folderInfo FolderInfo, tags []strin
 
 	defer tx.Rollback()
 
+	folderID, err := lookupFolder(tx, folderInfo)
+	if err != nil {
+		return err
+	}
+
+	for _, tagName := range tags {
+		_, err := tx.Exec(`
+			DELETE FROM folder_tags
+			WHERE folder_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)`, folderID, tagName)
+		if err != nil {
+			return fmt.Errorf("failed to unlink folder and tag: %w", err)
+		}
+	}
+
+	if err := removeOrphanedTags(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (repo *SqliteRepo) GetAliases() (tagexpr.Aliases, error) {
+	rows, err := repo.conn.Query(`SELECT alias, canonical FROM tag_aliases`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch aliases: %w", err)
+	}
+	defer rows.Close()
+
+	aliases := make(tagexpr.Aliases)
+	for rows.Next() {
+		var alias, canonical string
+		if err := rows.Scan(&alias, &canonical); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		aliases[strings.ToLower(alias)] = canonical
+	}
+
+	return aliases, rows.Err()
+}
+
+// AddAlias makes alias resolve to canonical. Aliases never point to other
+// aliases: a canonical tag that is an alias itself is resolved first, and
+// aliases of the new alias are redirected to its canonical tag.
+func (repo *SqliteRepo) AddAlias(alias string, canonical string) error {
+	tx, err := repo.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var resolved string
+	err = tx.QueryRow(`SELECT canonical FROM tag_aliases WHERE alias = ?`, canonical).Scan(&resolved)
+	if err == nil {
+		canonical = resolved
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to resolve %s: %w", canonical, err)
+	}
+
+	if strings.EqualFold(alias, canonical) {
+		return fmt.Errorf("%s can not be an alias of itself", alias)
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO tag_aliases (alias, canonical) VALUES (?, ?)`, alias, canonical)
+	if err != nil {
+		return fmt.Errorf("failed to add alias: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE tag_aliases SET canonical = ? WHERE canonical = ? COLLATE NOCASE`, canonical, alias)
+	if err != nil {
+		return fmt.Errorf("failed to redirect aliases of %s: %w", alias, err)
+	}
+
+	return tx.Commit()
+}
+
+func (repo *SqliteRepo) RemoveAlias(alias string) error {
+	result, err := repo.conn.Exec(`DELETE FROM tag_aliases WHERE alias = ?`, alias)
+	if err != nil {
+		return fmt.Errorf("failed to remove alias: %w", err)
+	}
+
+	if removed, err := result.RowsAffected(); err == nil && removed == 0 {
+		return fmt.Errorf("%s is not an alias", alias)
+	}
+
+	return nil
+}
+
+// RedirectAliases points the aliases of a renamed tag to its new name
+func (repo *SqliteRepo) RedirectAliases(from string, to string) error {
+	_, err := repo.conn.Exec(`UPDATE tag_aliases SET canonical = ? WHERE canonical = ?`, to, from)
+	if err != nil {
+		return fmt.Errorf("failed to redirect aliases of %s: %w", from, err)
+	}
+
+	// the new name itself can not stay an alias
+	_, err = repo.conn.Exec(`DELETE FROM tag_aliases WHERE alias = ?`, to)
+	return err
+}
+
+func (repo *SqliteRepo) StartTagOperation(op TagOperation) (int64, error) {
+	from, err := json.Marshal(op.From)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := repo.conn.Exec(`INSERT INTO tag_operations (kind, from_tags, to_tag, started_at) VALUES (?, ?, ?, ?)`,
+		string(op.Kind), string(from), op.To, op.StartedAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record tag operation: %w", err)
+	}
+
+	return result.LastInsertId()
+}
+
+func (repo *SqliteRepo) PendingTagOperations() ([]TagOperation, error) {
+	rows, err := repo.conn.Query(`SELECT id, kind, from_tags, to_tag, started_at FROM tag_operations ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tag operations: %w", err)
+	}
+	defer rows.Close()
+
+	var ops []TagOperation
+	for rows.Next() {
+		var op TagOperation
+		var kind, from string
+
+		if err := rows.Scan(&op.ID, &kind, &from, &op.To, &op.StartedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(from), &op.From); err != nil {
+			return nil, fmt.Errorf("invalid tag operation %d: %w", op.ID, err)
+		}
+
+		op.Kind = TagOperationKind(kind)
+		ops = append(ops, op)
+	}
+
+	return ops, rows.Err()
+}
+
+func (repo *SqliteRepo) FinishTagOperation(id int64) error {
+	_, err := repo.conn.Exec(`DELETE FROM tag_operations WHERE id = ?`, id)
+	return err
+}
+
+func (repo *SqliteRepo) GetAllLinks() ([]LinkInfo, error) {
+	query := `
+		SELECT
+			s.filepath,
+			r.filepath,
+			COALESCE(t.name, ''),
+			l.virtual_path,
+			l.mounted_at,
+			l.status
+		FROM links l
+		JOIN folders s ON l.source_folder_id = s.id
+		JOIN folders r ON l.receiver_folder_id = r.id
+		LEFT JOIN tags t ON l.tag_id = t.id
+		ORDER BY l.virtual_path
+	`
+
+	rows, err := repo.conn.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []LinkInfo
+	for rows.Next() {
+		var link LinkInfo
+		var status string
+
+		if err := rows.Scan(&link.Source, &link.Receiver, &link.Tag, &link.VirtualPath, &link.MountedAt, &status); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		link.Status = LinkStatus(status)
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range links {
+		layers, err := repo.linkLayers(links[i].VirtualPath)
+		if err != nil {
+			return nil, err
+		}
+		links[i].Layers = layers
+	}
+
+	return links, nil
+}
+
+func (repo *SqliteRepo) linkLayers(virtualPath string) ([]string, error) {
+	rows, err := repo.conn.Query(`
+		SELECT f.filepath
+		FROM link_layers ll
+		JOIN links l ON ll.link_id = l.id
+		JOIN folders f ON ll.folder_id = f.id
+		WHERE l.virtual_path = ?
+		ORDER BY ll.position
+	`, virtualPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch layers of %s: %w", virtualPath, err)
+	}
+	defer rows.Close()
+
+	var layers []string
+	for rows.Next() {
+		var layer string
+		if err := rows.Scan(&layer); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		layers = append(layers, layer)
+	}
+
+	return layers, rows.Err()
+}
+
+// AddLink records a link, replacing any earlier record for the same virtual path.
+func (repo *SqliteRepo) AddLink(link LinkInfo) error {
+	stmt := `
+		INSERT INTO links (source_folder_id, receiver_folder_id, tag_id, virtual_path, mounted_at, status)
+		VALUES (
+			?, ?,
+			(SELECT id FROM tags WHERE name = ?),
+			?, ?, ?
+		)
+		ON CONFLICT (virtual_path) DO UPDATE SET
+			source_folder_id = excluded.source_folder_id,
+			receiver_folder_id = excluded.receiver_folder_id,
+			tag_id = excluded.tag_id,
+			mounted_at = excluded.mounted_at,
+			status = excluded.status
+	`
+
+	tx, err := repo.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	sourceID, err := lookupFolderAt(tx, link.Source)
+	if err != nil {
+		return fmt.Errorf("failed to record link %s: %w", link.VirtualPath, err)
+	}
+
+	receiverID, err := lookupFolderAt(tx, link.Receiver)
+	if err != nil {
+		return fmt.Errorf("failed to record link %s: %w", link.VirtualPath, err)
+	}
+
+	_, err = tx.Exec(stmt, sourceID, receiverID, link.Tag, link.VirtualPath, link.MountedAt, string(link.Status))
+	if err != nil {
+		return fmt.Errorf("failed to record link %s: %w", link.VirtualPath, err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM link_layers WHERE link_id = (SELECT id FROM links WHERE virtual_path = ?)`, link.VirtualPath)
+	if err != nil {
+		return fmt.Errorf("failed to clear layers of %s: %w", link.VirtualPath, err)
+	}
+
+	for position, layer := range link.Layers {
+		layerID, err := lookupFolderAt(tx, layer)
+		if err != nil {
+			return fmt.Errorf("failed to record layer %s of %s: %w", layer, link.VirtualPath, err)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO link_layers (link_id, folder_id, position)
+			VALUES ((SELECT id FROM links WHERE virtual_path = ?), ?, ?)
+		`, link.VirtualPath, layerID, position)
+		if err != nil {
+			return fmt.Errorf("failed to record layer %s of %s: %w", layer, link.VirtualPath, err)
+		}
+	}
+
 	return tx.Commit()
 }
 
+func (repo *SqliteRepo) RemoveLink(virtualPath string) error {
+	_, err := repo.conn.Exec(`DELETE FROM links WHERE virtual_path = ?`, virtualPath)
+	return err
+}
+
+// GetSetting returns the value of a global setting, or "" when it is not set
+func (repo *SqliteRepo) GetSetting(key string) (string, error) {
+	var value string
+	err := repo.conn.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get setting %s: %w", key, err)
+	}
+	return value, nil
+}
+
+func (repo *SqliteRepo) SetSetting(key string, value string) error {
+	_, err := repo.conn.Exec(`INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to set setting %s: %w", key, err)
+	}
+	return nil
+}
+
+func (repo *SqliteRepo) RemoveSetting(key string) error {
+	_, err := repo.conn.Exec(`DELETE FROM settings WHERE key = ?`, key)
+	if err != nil {
+		return fmt.Errorf("failed to remove setting %s: %w", key, err)
+	}
+	return nil
+}
+
 func (repo *SqliteRepo) Obliterate() error {
 	fmt.Println("Obliterate not yet implemented")
 	return nil
@@ -224,11 +691,8 @@ func ensureDB(path string) error {
 
 	// Check if the database file exists
 	fileInfo, err := os.Stat(dbFilePath)
-	if err == nil {
-		if fileInfo.IsDir() {
-			return fmt.Errorf("database path exists but is a directory: %s", dbFilePath)
-		}
-		return nil
+	if err == nil && fileInfo.IsDir() {
+		return fmt.Errorf("database path exists but is a directory: %s", dbFilePath)
 	}
 
 	if os.IsNotExist(err) {
@@ -254,36 +718,7 @@ func ensureDB(path string) error {
 		return fmt.Errorf("failed to open DB for schema init: %w", err)
 	}
 	defer db.Close()
-	return initialiseDBschema(db)
-
-}
 
-func initialiseDBschema(db *sql.DB) error {
-	_, err := db.Exec(schema)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	_, err = migrate(db)
+	return err
 }
-
-const schema = `
-CREATE TABLE IF NOT EXISTS folders (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    inode INTEGER NOT NULL UNIQUE,
-    filepath TEXT NOT NULL UNIQUE
-);
-
-CREATE TABLE IF NOT EXISTS tags (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT NOT NULL UNIQUE
-);
-
-CREATE TABLE IF NOT EXISTS folder_tags (
-    folder_id INTEGER NOT NULL,
-    tag_id INTEGER NOT NULL,
-    PRIMARY KEY (folder_id, tag_id),
-    FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
-    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
-);
-`
@@ -2,9 +2,15 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
 )
 
 // This test will not pass for others
@@ -46,23 +52,41 @@ func TestEnsureDB(t *testing.T) {
 		tempDir := t.TempDir()
 		dbPath := filepath.Join(tempDir, databaseFilename)
 
-		// Create dummy file before calling ensureDB
-		originalContent := []byte("do not erase")
-		if err := os.WriteFile(dbPath, originalContent, 0644); err != nil {
-			t.Fatalf("failed to create dummy db file: %v", err)
+		// Create a database with data before calling ensureDB
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
 		}
+		defer db.Close()
 
-		err := ensureDB(tempDir)
+		if _, err := db.Exec(`CREATE TABLE keep (value TEXT); INSERT INTO keep VALUES ('do not erase')`); err != nil {
+			t.Fatalf("failed to create existing database: %v", err)
+		}
+
+		err = ensureDB(tempDir)
 		if err != nil {
 			t.Errorf("ensureDB failed on existing file: %v", err)
 		}
 
-		content, err := os.ReadFile(dbPath)
-		if err != nil {
-			t.Errorf("failed to read existing file after ensureDB: %v", err)
+		var content string
+		if err := db.QueryRow(`SELECT value FROM keep`).Scan(&content); err != nil {
+			t.Errorf("failed to read existing data after ensureDB: %v", err)
 		}
-		if string(content) != string(originalContent) {
-			t.Errorf("ensureDB overwrote existing file: got %q, want %q", string(content), string(originalContent))
+		if content != "do not erase" {
+			t.Errorf("ensureDB overwrote existing data: got %q, want %q", content, "do not erase")
+		}
+	})
+
+	t.Run("fails on a file that is not a database", func(t *testing.T) {
+		tempDir := t.TempDir()
+		dbPath := filepath.Join(tempDir, databaseFilename)
+
+		if err := os.WriteFile(dbPath, []byte("not a database, but long enough to have a header"), 0644); err != nil {
+			t.Fatalf("failed to create dummy db file: %v", err)
+		}
+
+		if err := ensureDB(tempDir); err == nil {
+			t.Errorf("expected error when the database file is not a database")
 		}
 	})
 
@@ -116,6 +140,7 @@ func TestEnsureDB(t *testing.T) {
 
 		expectedColumns := map[string]bool{
 			"id":       false,
+			"device":   false,
 			"inode":    false,
 			"filepath": false,
 		}
@@ -144,3 +169,540 @@ func TestEnsureDB(t *testing.T) {
 		}
 	})
 }
+
+func TestRemoveTagsFromFolder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	first := FolderInfo{Inode: 1, FullPath: "/first"}
+	second := FolderInfo{Inode: 2, FullPath: "/second"}
+	for _, folder := range []FolderInfo{first, second} {
+		if err := repo.AddFolder(folder); err != nil {
+			t.Fatalf("Could not add folder: %v", err)
+		}
+	}
+
+	if err := repo.AddTagsToFolder(first, []string{"go", "rust", "work"}); err != nil {
+		t.Fatalf("Could not add tags: %v", err)
+	}
+	if err := repo.AddTagsToFolder(second, []string{"work"}); err != nil {
+		t.Fatalf("Could not add tags: %v", err)
+	}
+
+	if err := repo.RemoveTagsFromFolder(first, []string{"rust", "work", "unknown"}); err != nil {
+		t.Fatalf("RemoveTagsFromFolder failed: %v", err)
+	}
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		t.Fatalf("Could not get folders: %v", err)
+	}
+
+	want := map[string][]string{"/first": {"go"}, "/second": {"work"}}
+	for _, folder := range folders {
+		if fmt.Sprint(folder.tags) != fmt.Sprint(want[folder.FullPath]) {
+			t.Errorf("tags for %s = %v, want %v", folder.FullPath, folder.tags, want[folder.FullPath])
+		}
+	}
+
+	var count int
+	if err := repo.conn.QueryRow(`SELECT COUNT(*) FROM tags WHERE name = 'rust'`).Scan(&count); err != nil {
+		t.Fatalf("Could not count tags: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected orphaned tag rust to be removed, found %d rows", count)
+	}
+}
+
+func TestHasFolder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	folder := FolderInfo{Inode: 1, FullPath: "/first"}
+
+	if exists, err := repo.HasFolder(folder); err != nil || exists {
+		t.Errorf("HasFolder before adding = %v, %v; want false, nil", exists, err)
+	}
+
+	if err := repo.AddFolder(folder); err != nil {
+		t.Fatalf("Could not add folder: %v", err)
+	}
+
+	if exists, err := repo.HasFolder(folder); err != nil || !exists {
+		t.Errorf("HasFolder after adding = %v, %v; want true, nil", exists, err)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	source := FolderInfo{Inode: 1, FullPath: "/src/docs"}
+	receiver := FolderInfo{Inode: 2, FullPath: "/recv"}
+	for _, folder := range []FolderInfo{source, receiver} {
+		if err := repo.AddFolder(folder); err != nil {
+			t.Fatalf("Could not add folder: %v", err)
+		}
+		if err := repo.AddTagsToFolder(folder, []string{"work"}); err != nil {
+			t.Fatalf("Could not add tags: %v", err)
+		}
+	}
+
+	link := LinkInfo{
+		Source:      source.FullPath,
+		Receiver:    receiver.FullPath,
+		Tag:         "work",
+		VirtualPath: "/recv/docs",
+		MountedAt:   time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Status:      LinkFailed,
+	}
+
+	if err := repo.AddLink(link); err != nil {
+		t.Fatalf("AddLink failed: %v", err)
+	}
+
+	// adding the same virtual path again updates the existing record
+	link.Status = LinkMounted
+	if err := repo.AddLink(link); err != nil {
+		t.Fatalf("AddLink failed: %v", err)
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		t.Fatalf("GetAllLinks failed: %v", err)
+	}
+	if len(links) != 1 {
+		t.Fatalf("expected 1 link, got %d", len(links))
+	}
+	if !links[0].MountedAt.Equal(link.MountedAt) {
+		t.Errorf("mounted at = %v, want %v", links[0].MountedAt, link.MountedAt)
+	}
+	links[0].MountedAt = link.MountedAt
+	if !reflect.DeepEqual(links[0], link) {
+		t.Errorf("link = %+v, want %+v", links[0], link)
+	}
+
+	if err := repo.AddLink(LinkInfo{Source: "/unknown", Receiver: "/recv", VirtualPath: "/recv/unknown", Status: LinkMounted}); err == nil {
+		t.Error("expected error when linking an unregistered folder")
+	}
+
+	if err := repo.RemoveFolder(source); err != nil {
+		t.Fatalf("RemoveFolder failed: %v", err)
+	}
+
+	links, err = repo.GetAllLinks()
+	if err != nil {
+		t.Fatalf("GetAllLinks failed: %v", err)
+	}
+	if len(links) != 0 {
+		t.Errorf("expected links of a removed folder to be removed, got %+v", links)
+	}
+
+	if err := repo.RemoveLink("/recv/docs"); err != nil {
+		t.Errorf("RemoveLink failed: %v", err)
+	}
+}
+
+func TestUnionLinkLayers(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	folders := []FolderInfo{
+		{Inode: 1, FullPath: "/src/a"},
+		{Inode: 2, FullPath: "/src/b"},
+		{Inode: 3, FullPath: "/recv"},
+	}
+	for _, folder := range folders {
+		if err := repo.AddFolder(folder); err != nil {
+			t.Fatalf("Could not add folder: %v", err)
+		}
+	}
+
+	link := LinkInfo{
+		Source:      "/src/b",
+		Receiver:    "/recv",
+		VirtualPath: "/recv/merged",
+		Status:      LinkMounted,
+		Layers:      []string{"/src/b", "/src/a"},
+	}
+	if err := repo.AddLink(link); err != nil {
+		t.Fatalf("AddLink failed: %v", err)
+	}
+
+	// rebuilding the union replaces its layers
+	link.Layers = []string{"/src/a"}
+	link.Source = "/src/a"
+	if err := repo.AddLink(link); err != nil {
+		t.Fatalf("AddLink failed: %v", err)
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		t.Fatalf("GetAllLinks failed: %v", err)
+	}
+	if len(links) != 1 || !reflect.DeepEqual(links[0].Layers, link.Layers) {
+		t.Errorf("links = %+v, want layers %v", links, link.Layers)
+	}
+
+	if err := repo.RemoveLink(link.VirtualPath); err != nil {
+		t.Fatalf("RemoveLink failed: %v", err)
+	}
+
+	var count int
+	if err := repo.conn.QueryRow(`SELECT COUNT(*) FROM link_layers`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("layers left after removing the link: %d, %v", count, err)
+	}
+}
+
+func TestFoldersOnDifferentDevices(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	// same inode number on two filesystems
+	first := FolderInfo{Device: 1, Inode: 7, FullPath: "/mnt/a/docs"}
+	second := FolderInfo{Device: 2, Inode: 7, FullPath: "/mnt/b/docs"}
+	for _, folder := range []FolderInfo{first, second} {
+		if err := repo.AddFolder(folder); err != nil {
+			t.Fatalf("Could not add folder %s: %v", folder.FullPath, err)
+		}
+	}
+
+	if err := repo.RemoveFolder(FolderInfo{Device: 2, Inode: 7}); err != nil {
+		t.Fatalf("RemoveFolder failed: %v", err)
+	}
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		t.Fatalf("Could not get folders: %v", err)
+	}
+	if len(folders) != 1 || folders[0].FullPath != first.FullPath || folders[0].Device != first.Device {
+		t.Errorf("expected only %+v to remain, got %+v", first, folders)
+	}
+}
+
+func TestUpdateFolder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	old := FolderInfo{Device: 0, Inode: 7, FullPath: "/old/docs"}
+	if err := repo.AddFolder(old); err != nil {
+		t.Fatalf("Could not add folder: %v", err)
+	}
+
+	moved := FolderInfo{Device: 3, Inode: 7, FullPath: "/new/docs"}
+	if err := repo.UpdateFolder(old, moved); err != nil {
+		t.Fatalf("UpdateFolder failed: %v", err)
+	}
+
+	if exists, err := repo.HasFolder(moved); err != nil || !exists {
+		t.Errorf("HasFolder after update = %v, %v; want true, nil", exists, err)
+	}
+
+	if err := repo.UpdateFolder(old, moved); err == nil {
+		t.Error("expected error when updating a folder that does not exist")
+	}
+}
+
+func TestHierarchicalTags(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	folder := FolderInfo{Inode: 1, FullPath: "/src"}
+	if err := repo.AddFolder(folder); err != nil {
+		t.Fatalf("Could not add folder: %v", err)
+	}
+
+	if err := repo.AddTagsToFolder(folder, []string{"lang/go/std", "lang/rust"}); err != nil {
+		t.Fatalf("Could not add tags: %v", err)
+	}
+
+	var parent string
+	err = repo.conn.QueryRow(`
+		SELECT p.name FROM tags t JOIN tags p ON t.parent_id = p.id
+		WHERE t.name = 'lang/go/std'`).Scan(&parent)
+	if err != nil || parent != "lang/go" {
+		t.Errorf("parent of lang/go/std = %q, %v; want lang/go", parent, err)
+	}
+
+	if err := repo.RemoveTagsFromFolder(folder, []string{"lang/go/std"}); err != nil {
+		t.Fatalf("RemoveTagsFromFolder failed: %v", err)
+	}
+
+	var names []string
+	rows, err := repo.conn.Query(`SELECT name FROM tags ORDER BY name`)
+	if err != nil {
+		t.Fatalf("Could not query tags: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+
+	// lang stays because lang/rust still needs it, lang/go is no longer used
+	if fmt.Sprint(names) != "[lang lang/rust]" {
+		t.Errorf("remaining tags = %v, want [lang lang/rust]", names)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	if err := repo.AddAlias("js", "javascript"); err != nil {
+		t.Fatalf("AddAlias failed: %v", err)
+	}
+
+	// an alias of an alias points to the canonical tag
+	if err := repo.AddAlias("ecmascript", "JS"); err != nil {
+		t.Fatalf("AddAlias failed: %v", err)
+	}
+
+	// making the canonical tag an alias redirects the existing aliases
+	if err := repo.AddAlias("javascript", "web/javascript"); err != nil {
+		t.Fatalf("AddAlias failed: %v", err)
+	}
+
+	if err := repo.AddAlias("Web/JavaScript", "web/javascript"); err == nil {
+		t.Error("expected error when aliasing a tag to itself")
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		t.Fatalf("GetAliases failed: %v", err)
+	}
+
+	want := tagexpr.Aliases{"js": "web/javascript", "ecmascript": "web/javascript", "javascript": "web/javascript"}
+	if fmt.Sprint(aliases) != fmt.Sprint(want) {
+		t.Errorf("aliases = %v, want %v", aliases, want)
+	}
+
+	if err := repo.RemoveAlias("JS"); err != nil {
+		t.Errorf("RemoveAlias failed: %v", err)
+	}
+	if err := repo.RemoveAlias("js"); err == nil {
+		t.Error("expected error when removing an alias that does not exist")
+	}
+}
+
+func TestTagOperations(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	op := TagOperation{Kind: TagMerge, From: []string{"js", "a,b"}, To: "javascript", StartedAt: time.Now()}
+	id, err := repo.StartTagOperation(op)
+	if err != nil {
+		t.Fatalf("StartTagOperation failed: %v", err)
+	}
+
+	ops, err := repo.PendingTagOperations()
+	if err != nil {
+		t.Fatalf("PendingTagOperations failed: %v", err)
+	}
+	if len(ops) != 1 || ops[0].ID != id || ops[0].Kind != TagMerge || fmt.Sprint(ops[0].From) != "[js a,b]" || ops[0].To != "javascript" {
+		t.Errorf("pending operations = %+v, want %+v", ops, op)
+	}
+
+	if err := repo.FinishTagOperation(id); err != nil {
+		t.Fatalf("FinishTagOperation failed: %v", err)
+	}
+
+	ops, err = repo.PendingTagOperations()
+	if err != nil || len(ops) != 0 {
+		t.Errorf("pending operations after finishing = %+v, %v; want none", ops, err)
+	}
+}
+
+func TestRedirectAliases(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	for alias, canonical := range map[string]string{"js": "javascript", "ecmascript": "javascript", "web": "www"} {
+		if err := repo.AddAlias(alias, canonical); err != nil {
+			t.Fatalf("AddAlias failed: %v", err)
+		}
+	}
+
+	if err := repo.RedirectAliases("javascript", "ecmascript"); err != nil {
+		t.Fatalf("RedirectAliases failed: %v", err)
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		t.Fatalf("GetAliases failed: %v", err)
+	}
+
+	want := tagexpr.Aliases{"js": "ecmascript", "web": "www"}
+	if fmt.Sprint(aliases) != fmt.Sprint(want) {
+		t.Errorf("aliases = %v, want %v", aliases, want)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	if value, err := repo.GetSetting("backend"); err != nil || value != "" {
+		t.Errorf("GetSetting of a missing key = %q, %v; want empty", value, err)
+	}
+
+	for _, value := range []string{"symlink", "bind"} {
+		if err := repo.SetSetting("backend", value); err != nil {
+			t.Fatalf("SetSetting failed: %v", err)
+		}
+		if got, err := repo.GetSetting("backend"); err != nil || got != value {
+			t.Errorf("GetSetting = %q, %v; want %q", got, err, value)
+		}
+	}
+
+	if err := repo.RemoveSetting("backend"); err != nil {
+		t.Fatalf("RemoveSetting failed: %v", err)
+	}
+	if value, _ := repo.GetSetting("backend"); value != "" {
+		t.Errorf("setting still present after removal: %q", value)
+	}
+}
+
+func TestMovedFolder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	old := FolderInfo{Device: 1, Inode: 7, FullPath: "/old/docs"}
+	if err := repo.AddFolder(old); err != nil {
+		t.Fatalf("Could not add folder: %v", err)
+	}
+
+	// tagging a moved folder finds it by device and inode and stores its new path
+	moved := FolderInfo{Device: 1, Inode: 7, FullPath: "/new/docs"}
+	if err := repo.AddTagsToFolder(moved, []string{"work"}); err != nil {
+		t.Fatalf("AddTagsToFolder failed: %v", err)
+	}
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		t.Fatalf("Could not get folders: %v", err)
+	}
+	if len(folders) != 1 || folders[0].FullPath != moved.FullPath || !reflect.DeepEqual(folders[0].tags, []string{"work"}) {
+		t.Errorf("folders = %+v, want only %s tagged work", folders, moved.FullPath)
+	}
+
+	// adding it again at yet another path keeps its tags
+	again := FolderInfo{Device: 1, Inode: 7, FullPath: "/other/docs"}
+	if err := repo.AddFolder(again); err != nil {
+		t.Fatalf("AddFolder of a moved folder failed: %v", err)
+	}
+
+	// a folder recreated at a known path takes over the record
+	recreated := FolderInfo{Device: 1, Inode: 9, FullPath: again.FullPath}
+	if err := repo.AddFolder(recreated); err != nil {
+		t.Fatalf("AddFolder of a recreated folder failed: %v", err)
+	}
+
+	folders, err = repo.GetAllFolders()
+	if err != nil {
+		t.Fatalf("Could not get folders: %v", err)
+	}
+	if len(folders) != 1 || folders[0].Inode != recreated.Inode || folders[0].FullPath != recreated.FullPath || len(folders[0].tags) != 1 {
+		t.Errorf("folders = %+v, want only %+v with its tags", folders, recreated)
+	}
+
+	if err := repo.RemoveTagsFromFolder(recreated, []string{"work"}); err != nil {
+		t.Fatalf("RemoveTagsFromFolder failed: %v", err)
+	}
+	if err := repo.RemoveTagsFromFolder(old, []string{"work"}); err == nil {
+		t.Error("expected error when removing tags from an unknown folder")
+	}
+}
+
+func TestRemoveFolderWithoutDevice(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	// migrated folders that could not be backfilled have device 0
+	migrated := FolderInfo{Device: 0, Inode: 7, FullPath: "/src/docs"}
+	if err := repo.AddFolder(migrated); err != nil {
+		t.Fatalf("Could not add folder: %v", err)
+	}
+
+	if exists, err := repo.HasFolder(FolderInfo{Device: 4, Inode: 7, FullPath: migrated.FullPath}); err != nil || !exists {
+		t.Errorf("HasFolder = %v, %v; want true, nil", exists, err)
+	}
+
+	if err := repo.RemoveFolder(FolderInfo{Device: 4, Inode: 7, FullPath: "/elsewhere"}); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("RemoveFolder at another path = %v, want %v", err, ErrFolderNotFound)
+	}
+
+	if err := repo.RemoveFolder(FolderInfo{Device: 4, Inode: 7, FullPath: migrated.FullPath}); err != nil {
+		t.Fatalf("RemoveFolder failed: %v", err)
+	}
+
+	if err := repo.RemoveFolder(migrated); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("RemoveFolder of a removed folder = %v, want %v", err, ErrFolderNotFound)
+	}
+}
@@ -0,0 +1,21 @@
+package repository
+
+import "time"
+
+type TagOperationKind string
+
+const (
+	TagRename TagOperationKind = "rename"
+	TagMerge  TagOperationKind = "merge"
+)
+
+// TagOperation is a global rename or merge of tags. It is recorded before any
+// folder is changed and removed once all folders are done, so an interrupted
+// operation can be resumed.
+type TagOperation struct {
+	ID        int64            `json:"id"`
+	Kind      TagOperationKind `json:"kind"`
+	From      []string         `json:"from"`
+	To        string           `json:"to"`
+	StartedAt time.Time        `json:"started_at"`
+}
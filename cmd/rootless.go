@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// rootlessSettingKey stores whether rootless mode is on in the settings table
+const rootlessSettingKey = "rootless"
+
+// namespaceEnv is set for semlink and the commands it starts inside its own
+// user and mount namespace.
+const namespaceEnv = "SEMLINK_NAMESPACE"
+
+var rootlessCmd = &cobra.Command{
+	Use:   "rootless",
+	Short: "Manage rootless mode",
+	Long: `In rootless mode ordinary users can tag folders and change receivers without root.
+The mounts are not made for the whole system, but only inside 'semlink shell' and
+'semlink exec', which run in their own user and mount namespace. Other programs keep
+seeing empty virtual directories.
+
+Inside the namespace you appear as root, files you own show up as owned by root.
+This needs a kernel that allows unprivileged user namespaces.`,
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Start a shell that sees the mounted virtual directories",
+	Long: `Start $SHELL in a new user and mount namespace with all virtual directories mounted.
+The mounts disappear when the shell exits. Works without root, see 'semlink rootless --help'.`,
+	Args: cobra.NoArgs,
+	Run:  runShell,
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] -- command [args...]",
+	Short: "Run a command that sees the mounted virtual directories",
+	Long: `Run a command in a new user and mount namespace with all virtual directories mounted.
+The exit code is the one of the command. Works without root, see 'semlink rootless --help'.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runExec,
+}
+
+func init() {
+	enableCmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Let ordinary users change semlink, mounts are only made by 'semlink shell' and 'semlink exec'",
+		Args:  cobra.NoArgs,
+		Run:   runRootlessEnable,
+	}
+
+	disableCmd := &cobra.Command{
+		Use:   "disable",
+		Short: "Require root for changes again",
+		Args:  cobra.NoArgs,
+		Run:   runRootlessDisable,
+	}
+
+	rootlessCmd.AddCommand(enableCmd)
+	rootlessCmd.AddCommand(disableCmd)
+
+	rootCmd.AddCommand(rootlessCmd)
+	rootCmd.AddCommand(shellCmd)
+	rootCmd.AddCommand(execCmd)
+}
+
+func runRootlessEnable(cmd *cobra.Command, args []string) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	if err := repo.SetSetting(rootlessSettingKey, "true"); err != nil {
+		log.Fatalf("Failed to enable rootless mode: %v", err)
+	}
+
+	fmt.Println("Rootless mode enabled, use 'semlink shell' or 'semlink exec' to see the virtual directories")
+}
+
+func runRootlessDisable(cmd *cobra.Command, args []string) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	if err := repo.RemoveSetting(rootlessSettingKey); err != nil {
+		log.Fatalf("Failed to disable rootless mode: %v", err)
+	}
+}
+
+// rootlessEnabled is looked up once, like globalBackendNeedsPrivileges
+var rootlessEnabled = sync.OnceValue(func() bool {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		return false
+	}
+
+	value, err := repo.GetSetting(rootlessSettingKey)
+	return err == nil && value == "true"
+})
+
+// mountsAreDeferred reports whether this process may change semlink but not
+// mount, not even through the mount helper, so the mounts wait for 'semlink
+// shell' or 'semlink exec'.
+func mountsAreDeferred() bool {
+	return globalBackendNeedsPrivileges() && !isPrivileged() && !mountHelperAvailable()
+}
+
+func runShell(cmd *cobra.Command, args []string) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	runInNamespace([]string{shell})
+}
+
+func runExec(cmd *cobra.Command, args []string) {
+	runInNamespace(args)
+}
+
+// runInNamespace runs semlink again in a new user and mount namespace, where
+// it mounts the virtual directories and then becomes the command.
+func runInNamespace(command []string) {
+	if os.Getenv(namespaceEnv) == "" {
+		os.Exit(enterNamespace())
+	}
+
+	// keep receiving mounts from the host, like new USB drives, but never send ours back
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_SLAVE, ""); err != nil {
+		log.Fatalf("Failed to make the mount namespace private: %v", err)
+	}
+
+	// the mounts only exist in this namespace, so they stay out of the links table
+	mountDirectories(false)
+
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		log.Fatalf("Failed to find %s: %v", command[0], err)
+	}
+
+	if err := unix.Exec(path, command, os.Environ()); err != nil {
+		log.Fatalf("Failed to run %s: %v", path, err)
+	}
+}
+
+// enterNamespace starts semlink with the same arguments in new namespaces and
+// returns its exit code.
+func enterNamespace() int {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Failed to find the semlink executable: %v", err)
+	}
+
+	child := exec.Command(self, os.Args[1:]...)
+	child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+	child.Env = append(os.Environ(), namespaceEnv+"=1")
+	child.SysProcAttr = namespaceAttr(isPrivileged(), os.Getuid(), os.Getgid())
+
+	// Ctrl+C is meant for the command, which decides whether to exit
+	signal.Ignore(os.Interrupt, syscall.SIGQUIT)
+
+	err = child.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitCode(exitErr.Sys().(syscall.WaitStatus))
+	} else if err != nil {
+		log.Fatalf("Failed to create a user and mount namespace: %v, unprivileged user namespaces may be disabled on this system", err)
+	}
+
+	return 0
+}
+
+// namespaceAttr makes the child root inside a new user namespace, which lets
+// it mount the folders its user can access. A process that can mount already
+// only needs a mount namespace.
+func namespaceAttr(canMount bool, uid int, gid int) *syscall.SysProcAttr {
+	if canMount {
+		return &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	}
+
+	return &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+}
+
+// exitCode passes on the exit code of the command, and signals the way shells do
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
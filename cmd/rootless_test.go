@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestNamespaceAttr(t *testing.T) {
+	attr := namespaceAttr(false, 1000, 100)
+	if attr.Cloneflags != syscall.CLONE_NEWUSER|syscall.CLONE_NEWNS {
+		t.Errorf("Cloneflags = %#x, want a user and mount namespace", attr.Cloneflags)
+	}
+	if len(attr.UidMappings) != 1 || attr.UidMappings[0] != (syscall.SysProcIDMap{ContainerID: 0, HostID: 1000, Size: 1}) {
+		t.Errorf("UidMappings = %v, want 1000 mapped to root", attr.UidMappings)
+	}
+	if len(attr.GidMappings) != 1 || attr.GidMappings[0] != (syscall.SysProcIDMap{ContainerID: 0, HostID: 100, Size: 1}) {
+		t.Errorf("GidMappings = %v, want 100 mapped to root", attr.GidMappings)
+	}
+
+	attr = namespaceAttr(true, 1000, 100)
+	if attr.Cloneflags != syscall.CLONE_NEWNS || attr.UidMappings != nil {
+		t.Errorf("a process that can mount got %#x %v, want only a mount namespace", attr.Cloneflags, attr.UidMappings)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		status syscall.WaitStatus
+		want   int
+	}{
+		{0, 0},
+		{3 << 8, 3},                      // exit(3)
+		{syscall.WaitStatus(2), 128 + 2}, // killed by SIGINT
+	}
+
+	for _, tt := range tests {
+		if got := exitCode(tt.status); got != tt.want {
+			t.Errorf("exitCode(%#x) = %d, want %d", uint32(tt.status), got, tt.want)
+		}
+	}
+}
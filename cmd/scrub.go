@@ -1,9 +1,10 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"path/filepath"
 
 	"golang.org/x/sys/unix"
 
@@ -31,8 +32,6 @@ func init() {
 	scrubCmd.Flags().BoolVarP(&allFlag, "all", "a", false, "Remove all semlink xattr data, including type information and database")
 }
 
-//  TODO: for each folder you want to scrub, if its virtual, unmount everything in it
-
 func runScrub(cmd *cobra.Command, args []string) {
 	ensureIsPrivileged()
 
@@ -51,29 +50,31 @@ func runScrub(cmd *cobra.Command, args []string) {
 	// If --all flag is set, remove the semlink.type xattr as well
 	if allFlag {
 
-		// Get inode for the file info
-		var stat unix.Stat_t
-		if err := unix.Stat(path, &stat); err != nil {
-			log.Fatalf("Failed to stat file: %v", err)
+		repo, err := repository.NewSqliteRepo()
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
 
-		inode := stat.Ino
+		// Without a type semlink no longer knows about the mounts inside this folder
+		if err := unmountChildren(repo, path); err != nil {
+			log.Fatalf("%v", err)
+		}
 
-		repo, err := repository.NewSqliteRepo()
+		folder, err := statFolder(path)
 		if err != nil {
 			log.Fatalf("%v", err)
 		}
 
 		// Remove from registry
-		if err := repo.RemoveFolder(repository.FolderInfo{Inode: inode}); err != nil {
+		err = repo.RemoveFolder(folder)
+		if errors.Is(err, repository.ErrFolderNotFound) {
+			fmt.Printf("No database entry found for %s\n", path)
+		} else if err != nil {
 			log.Fatalf("Failed to remove entry from database: %v", err)
-			os.Exit(1)
+		} else {
+			fmt.Printf("Successfully removed database entry for %s\n", path)
 		}
 
-		// TODO: remove tags from folder_tags
-
-		fmt.Printf("Successfully removed database entry for %s\n", path)
-
 		err = unix.Removexattr(path, semlinkTypeXattrKey)
 		if err != nil && err != unix.ENODATA {
 			log.Fatalf("Failed to remove type xattr: %v", err)
@@ -87,3 +88,47 @@ func runScrub(cmd *cobra.Command, args []string) {
 
 	triggerUpdate()
 }
+
+// unmountChildren tears down the virtual directories semlink mounted inside path.
+func unmountChildren(repo *repository.SqliteRepo, path string) error {
+	folderType, err := getSemlinkType(path)
+	if err != nil || Type(folderType) != RECEIVER {
+		return err
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve absolute path: %w", err)
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		return err
+	}
+
+	var inside []repository.LinkInfo
+	for _, l := range links {
+		if l.Receiver == absPath {
+			inside = append(inside, l)
+		}
+	}
+
+	owned := ownedMounts(mounts, []string{absPath}, trackedLinks(inside), isVirtualDirectory)
+	errs := teardown(repo, teardownOrder(owned), false)
+	errs = append(errs, removeLeftoverVirtualDirectories([]string{absPath})...)
+
+	for _, err := range errs {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("could not unmount everything inside %s", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the virtual directories and how they are mounted",
+	Long: `List every virtual directory semlink mounted, with its source and the effective
+mount flags from the mount table. Links of the symlink backend show as 'linked'.
+A link is 'missing' when it was mounted but is not in the mount table anymore,
+e.g. after a reboot. Run 'semlink sync' to restore it.`,
+	Args: cobra.NoArgs,
+	Run:  runStatus,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		log.Fatalf("Failed to get links: %v", err)
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		log.Fatalf("Failed to read mount table: %v", err)
+	}
+
+	if len(links) == 0 {
+		fmt.Println("No virtual directories")
+		return
+	}
+
+	sort.Slice(links, func(i, j int) bool { return links[i].VirtualPath < links[j].VirtualPath })
+
+	top := topMounts(mounts)
+	for _, l := range links {
+		state, flags := linkState(l, top)
+
+		source := l.Source
+		if l.Layers != nil {
+			source = "union of " + strings.Join(l.Layers, ", ")
+		}
+
+		fmt.Printf("%-8s %s -> %s  [%s]\n", state, source, l.VirtualPath, flags)
+	}
+}
+
+// linkState describes a link by the mount table, falling back to the recorded
+// status when it is not mounted.
+func linkState(l repository.LinkInfo, top map[string]mountInfo) (string, string) {
+	if _, ok := backendAt(l.VirtualPath).(symlinkBackend); ok {
+		return "linked", string(backendSymlink)
+	}
+
+	mount, ok := top[l.VirtualPath]
+	if !ok {
+		if l.Status == repository.LinkFailed {
+			return string(repository.LinkFailed), "-"
+		}
+		return "missing", "-"
+	}
+
+	return string(repository.LinkMounted), mount.options
+}
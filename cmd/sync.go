@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+)
+
+var dryRunFlag bool
+
+var syncCmd = &cobra.Command{
+	Use:     "sync",
+	Aliases: []string{"up"},
+	Short:   "Mount all virtual directories",
+	Long: `Reconcile the mounted virtual directories with the database and the folders' xattr data.
+Missing links are mounted and links that are no longer wanted are unmounted.
+Bind mounts do not survive a reboot, so this is meant to be run at startup.
+
+Exit codes:
+  0  all mounts are up to date
+  1  the database or the mount table could not be read
+  2  one or more mounts could not be changed
+  3  --dry-run found changes that have not been applied`,
+	Args: cobra.NoArgs,
+	Run:  runSync,
+}
+
+func init() {
+	syncCmd.Flags().BoolVarP(&dryRunFlag, "dry-run", "n", false, "Only print the changes that would be made")
+	syncCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
+
+	rootCmd.AddCommand(syncCmd)
+}
+
+func runSync(cmd *cobra.Command, args []string) {
+	if !dryRunFlag {
+		ensureIsPrivileged()
+
+		if mountsAreDeferred() {
+			fmt.Fprintln(os.Stderr, "Error: in rootless mode the virtual directories are only mounted by 'semlink shell' and 'semlink exec'")
+			os.Exit(exitFatal)
+		}
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	diff, err := computeMountDiff(repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	printMountDiff(diff)
+
+	if dryRunFlag {
+		if !diff.isEmpty() {
+			os.Exit(exitPendingMount)
+		}
+		os.Exit(exitOK)
+	}
+
+	errs := applyMountDiff(repo, diff, true)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+
+	if len(errs) > 0 {
+		os.Exit(exitMountFailed)
+	}
+}
@@ -0,0 +1,428 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"github.com/spf13/cobra"
+)
+
+var rewriteFlag bool
+
+var tagCmd = &cobra.Command{
+	Use:   "tag",
+	Short: "Manage tags",
+	Long:  `Manage tags across all directories.`,
+}
+
+func init() {
+	aliasCmd := &cobra.Command{
+		Use:   "alias [flags] alias tag",
+		Short: "Make a tag an alias of another tag",
+		Long: `Make a tag an alias of another, canonical tag. Aliases are matched case insensitively
+and resolve to the canonical tag in add, untag, query and the mount pass. With js aliased
+to javascript, js/react resolves to javascript/react.`,
+		Args: cobra.ExactArgs(2),
+		Run:  runTagAlias,
+	}
+	aliasCmd.Flags().BoolVarP(&rewriteFlag, "rewrite", "r", false, "Replace the alias by the canonical tag in the xattr data of every directory")
+
+	unaliasCmd := &cobra.Command{
+		Use:   "unalias alias",
+		Short: "Remove an alias",
+		Args:  cobra.ExactArgs(1),
+		Run:   runTagUnalias,
+	}
+
+	aliasesCmd := &cobra.Command{
+		Use:   "aliases",
+		Short: "List all aliases",
+		Args:  cobra.NoArgs,
+		Run:   runTagAliases,
+	}
+
+	renameCmd := &cobra.Command{
+		Use:   "rename old new",
+		Short: "Rename a tag on all directories",
+		Long: `Rename a tag, and the tags below it in the hierarchy, on every registered directory.
+The xattr data, the database and the aliases are updated, and the affected links are
+remounted. Use 'semlink tag merge' when the new tag is already in use.`,
+		Args: cobra.ExactArgs(2),
+		Run:  runTagRename,
+	}
+
+	mergeCmd := &cobra.Command{
+		Use:   "merge tag... target",
+		Short: "Merge tags into one tag on all directories",
+		Long: `Replace one or more tags, and the tags below them in the hierarchy, by the target tag
+on every registered directory. The target tag may already be in use.`,
+		Args: cobra.MinimumNArgs(2),
+		Run:  runTagMerge,
+	}
+
+	resumeCmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Finish interrupted renames and merges",
+		Args:  cobra.NoArgs,
+		Run:   runTagResume,
+	}
+
+	tagCmd.AddCommand(aliasCmd)
+	tagCmd.AddCommand(unaliasCmd)
+	tagCmd.AddCommand(aliasesCmd)
+	tagCmd.AddCommand(renameCmd)
+	tagCmd.AddCommand(mergeCmd)
+	tagCmd.AddCommand(resumeCmd)
+
+	rootCmd.AddCommand(tagCmd)
+}
+
+func runTagAlias(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	alias := tagexpr.Normalize(args[0])
+	canonical := tagexpr.Normalize(args[1])
+	for _, tag := range []string{alias, canonical} {
+		if err := tagexpr.Validate(tag); err != nil {
+			log.Fatalf("Invalid tag: %v", err)
+		}
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	if err := repo.AddAlias(alias, canonical); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	fmt.Printf("%s is now an alias of %s\n", alias, aliases.Resolve(alias))
+
+	if rewriteFlag {
+		for _, err := range rewriteAliasedTags(repo, aliases) {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+
+	triggerUpdate()
+}
+
+func runTagUnalias(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	if err := repo.RemoveAlias(tagexpr.Normalize(args[0])); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	triggerUpdate()
+}
+
+func runTagAliases(cmd *cobra.Command, args []string) {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var names []string
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+
+	for _, alias := range names {
+		fmt.Printf("%s -> %s\n", alias, aliases[alias])
+	}
+}
+
+// rewriteAliasedTags replaces aliased tags by their canonical tag, in both the
+// xattr data and the database of every registered folder.
+func rewriteAliasedTags(repo *repository.SqliteRepo, aliases tagexpr.Aliases) []error {
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, folder := range folders {
+		tags, err := getSemlinkTags(folder.FullPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		resolved := aliases.ResolveAll(tags)
+		if slices.Equal(tags, resolved) {
+			continue
+		}
+
+		setSemlinkTags(folder.FullPath, resolved)
+
+		if err := repo.AddTagsToFolder(folder, resolved); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var replaced []string
+		for _, tag := range tags {
+			if !slices.Contains(resolved, tag) {
+				replaced = append(replaced, tag)
+			}
+		}
+
+		if err := repo.RemoveTagsFromFolder(folder, replaced); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		fmt.Printf("Rewrote %s: %s -> %s\n", folder.FullPath, strings.Join(tags, ", "), strings.Join(resolved, ", "))
+	}
+
+	return errs
+}
+
+func runTagRename(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	from := tagexpr.Normalize(args[0])
+	to := tagexpr.Normalize(args[1])
+
+	repo := repositoryWithoutPendingOperations()
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	for _, folder := range folders {
+		for _, tag := range folder.Tags() {
+			if tagexpr.Covers(to, tag) {
+				log.Fatalf("%s is already in use on %s, use 'semlink tag merge %s %s' instead", to, folder.FullPath, from, to)
+			}
+		}
+	}
+
+	runTagOperation(repo, repository.TagOperation{Kind: repository.TagRename, From: []string{from}, To: to})
+}
+
+func runTagMerge(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	var from []string
+	for _, tag := range args[:len(args)-1] {
+		from = append(from, tagexpr.Normalize(tag))
+	}
+	to := tagexpr.Normalize(args[len(args)-1])
+
+	repo := repositoryWithoutPendingOperations()
+
+	runTagOperation(repo, repository.TagOperation{Kind: repository.TagMerge, From: from, To: to})
+}
+
+func runTagResume(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	ops, err := repo.PendingTagOperations()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if len(ops) == 0 {
+		fmt.Println("No interrupted tag operations")
+		return
+	}
+
+	failed := false
+	for _, op := range ops {
+		fmt.Printf("Resuming %s of %s into %s\n", op.Kind, strings.Join(op.From, ", "), op.To)
+
+		for _, err := range applyTagOperation(repo, op) {
+			fmt.Printf("Error: %v\n", err)
+			failed = true
+		}
+	}
+
+	triggerUpdate()
+
+	if failed {
+		log.Fatalf("Not all tag operations could be finished, run 'semlink tag resume' again")
+	}
+}
+
+func repositoryWithoutPendingOperations() *repository.SqliteRepo {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	ops, err := repo.PendingTagOperations()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if len(ops) > 0 {
+		log.Fatalf("An earlier tag %s was interrupted, run 'semlink tag resume' first", ops[0].Kind)
+	}
+
+	return repo
+}
+
+// runTagOperation records the operation, so it can be resumed, and applies it
+func runTagOperation(repo *repository.SqliteRepo, op repository.TagOperation) {
+	if err := tagexpr.Validate(op.To); err != nil {
+		log.Fatalf("Invalid tag: %v", err)
+	}
+
+	op.StartedAt = time.Now()
+
+	id, err := repo.StartTagOperation(op)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	op.ID = id
+
+	errs := applyTagOperation(repo, op)
+	for _, err := range errs {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	triggerUpdate()
+
+	if len(errs) > 0 {
+		log.Fatalf("The tag %s was not finished, run 'semlink tag resume' to retry", op.Kind)
+	}
+}
+
+// applyTagOperation renames the tags of every folder, in the xattr data and in
+// the database. Every step can safely be repeated, so an interrupted operation
+// is resumed by applying it again. The operation is finished when nothing failed.
+func applyTagOperation(repo *repository.SqliteRepo, op repository.TagOperation) []error {
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, folder := range folders {
+		tags, err := getSemlinkTags(folder.FullPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if renamed, changed := renameTags(tags, op.From, op.To); changed {
+			setSemlinkTags(folder.FullPath, renamed)
+			fmt.Printf("Rewrote %s: %s -> %s\n", folder.FullPath, strings.Join(tags, ", "), strings.Join(renamed, ", "))
+		}
+
+		if err := renameQuery(folder.FullPath, op.From, op.To); err != nil {
+			errs = append(errs, err)
+		}
+
+		stored := folder.Tags()
+		renamed, changed := renameTags(stored, op.From, op.To)
+		if !changed {
+			continue
+		}
+
+		if err := repo.AddTagsToFolder(folder, renamed); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var replaced []string
+		for _, tag := range stored {
+			if !slices.Contains(renamed, tag) {
+				replaced = append(replaced, tag)
+			}
+		}
+
+		if err := repo.RemoveTagsFromFolder(folder, replaced); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, from := range op.From {
+		if err := repo.RedirectAliases(from, op.To); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		if err := repo.FinishTagOperation(op.ID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// renameQuery rewrites the query of a receiver that refers to one of the
+// renamed tags. An invalid query is reported and left as it is, so it does not
+// keep the operation from finishing.
+func renameQuery(path string, from []string, to string) error {
+	queryString, err := getXattr(path, semlinkQueryXattrKey)
+	if err != nil || strings.TrimSpace(queryString) == "" {
+		return err
+	}
+
+	query, err := tagexpr.Parse(queryString)
+	if err != nil {
+		fmt.Printf("Warning: not rewriting the invalid query %q of %s: %v\n", queryString, path, err)
+		return nil
+	}
+
+	if renamed, changed := tagexpr.RenameExpr(query, from, to); changed {
+		setXattr(path, semlinkQueryXattrKey, renamed.String())
+		fmt.Printf("Rewrote the query of %s: %s -> %s\n", path, query, renamed)
+	}
+	return nil
+}
+
+// renameTags renames every tag covered by one of from, removing the duplicates this creates
+func renameTags(tags []string, from []string, to string) ([]string, bool) {
+	renamed := []string{}
+	changed := false
+
+	for _, tag := range tags {
+		for _, f := range from {
+			if newTag, ok := tagexpr.Rename(tag, f, to); ok {
+				tag = newTag
+				changed = true
+				break
+			}
+		}
+
+		if !slices.Contains(renamed, tag) {
+			renamed = append(renamed, tag)
+		}
+	}
+
+	return renamed, changed
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"golang.org/x/sys/unix"
+)
+
+func TestRenameTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     []string
+		from     []string
+		to       string
+		expected []string
+		changed  bool
+	}{
+		{"rename", []string{"js", "web"}, []string{"js"}, "javascript", []string{"javascript", "web"}, true},
+		{"descendants", []string{"lang/go/std", "lang/rust"}, []string{"lang/go"}, "golang", []string{"golang/std", "lang/rust"}, true},
+		{"merge into existing", []string{"js", "JS", "javascript"}, []string{"js", "JS"}, "javascript", []string{"javascript"}, true},
+		{"unaffected", []string{"web"}, []string{"js"}, "javascript", []string{"web"}, false},
+		{"into a child", []string{"lang", "lang/rust"}, []string{"lang"}, "lang/go", []string{"lang/go", "lang/go/rust"}, true},
+		{"into a child again", []string{"lang/go", "lang/go/rust"}, []string{"lang"}, "lang/go", []string{"lang/go", "lang/go/rust"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, changed := renameTags(tt.tags, tt.from, tt.to)
+			if !reflect.DeepEqual(result, tt.expected) || changed != tt.changed {
+				t.Errorf("renameTags(%v, %v, %q) = %v, %v; want %v, %v", tt.tags, tt.from, tt.to, result, changed, tt.expected, tt.changed)
+			}
+		})
+	}
+}
+
+func TestApplyTagOperationResume(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_USER", "")
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		t.Fatalf("Could not create repository: %v", err)
+	}
+
+	source, receiver := t.TempDir(), t.TempDir()
+	if err := unix.Setxattr(source, semlinkTagXattrKey, []byte(encodeTags([]string{"lang", "web"})), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("user xattrs are not supported here")
+		}
+		t.Fatalf("Setxattr: %v", err)
+	}
+	setXattr(receiver, semlinkQueryXattrKey, "lang AND NOT old")
+
+	for _, path := range []string{source, receiver} {
+		folder, err := statFolder(path)
+		if err != nil {
+			t.Fatalf("statFolder: %v", err)
+		}
+		if err := repo.AddFolder(folder); err != nil {
+			t.Fatalf("Could not add folder: %v", err)
+		}
+		if path == source {
+			repo.AddTagsToFolder(folder, []string{"lang", "web"})
+		}
+	}
+
+	op := repository.TagOperation{Kind: repository.TagRename, From: []string{"lang"}, To: "lang/go", StartedAt: time.Now()}
+	if op.ID, err = repo.StartTagOperation(op); err != nil {
+		t.Fatalf("StartTagOperation: %v", err)
+	}
+
+	// interrupted after rewriting the xattrs, before the database
+	setSemlinkTags(source, []string{"lang/go", "web"})
+	setXattr(receiver, semlinkQueryXattrKey, "(lang/go AND NOT old)")
+
+	for range 2 {
+		if errs := applyTagOperation(repo, op); len(errs) > 0 {
+			t.Fatalf("applyTagOperation: %v", errs)
+		}
+	}
+
+	if tags, _ := getSemlinkTags(source); !reflect.DeepEqual(tags, []string{"lang/go", "web"}) {
+		t.Errorf("source xattr tags = %v, want [lang/go web]", tags)
+	}
+	if query, _ := getXattr(receiver, semlinkQueryXattrKey); query != "(lang/go AND NOT old)" {
+		t.Errorf("receiver query = %q, want (lang/go AND NOT old)", query)
+	}
+
+	folders, err := repo.GetAllFolders()
+	if err != nil {
+		t.Fatalf("GetAllFolders: %v", err)
+	}
+	for _, folder := range folders {
+		if folder.FullPath == source && !reflect.DeepEqual(slices.Sorted(slices.Values(folder.Tags())), []string{"lang/go", "web"}) {
+			t.Errorf("stored tags = %v, want [lang/go web]", folder.Tags())
+		}
+	}
+
+	if ops, _ := repo.PendingTagOperations(); len(ops) != 0 {
+		t.Errorf("operation still pending: %v", ops)
+	}
+}
@@ -0,0 +1,55 @@
+package tagexpr
+
+import "strings"
+
+// Aliases maps lower cased alias names to their canonical tag
+type Aliases map[string]string
+
+// Resolve replaces an aliased tag, or an aliased ancestor of it, by its
+// canonical tag. With js aliased to javascript, js/react resolves to
+// javascript/react. Aliases are matched case insensitively.
+func (aliases Aliases) Resolve(tag string) string {
+	tag = Normalize(tag)
+
+	levels := strings.Split(tag, Separator)
+	for i := len(levels); i > 0; i-- {
+		prefix := strings.Join(levels[:i], Separator)
+		if canonical, ok := aliases[strings.ToLower(prefix)]; ok {
+			return Normalize(strings.Join(append([]string{canonical}, levels[i:]...), Separator))
+		}
+	}
+
+	return tag
+}
+
+// ResolveAll resolves every tag and drops the duplicates this creates
+func (aliases Aliases) ResolveAll(tags []string) []string {
+	resolved := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = aliases.Resolve(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			resolved = append(resolved, tag)
+		}
+	}
+	return resolved
+}
+
+// ResolveExpr resolves the tags an expression refers to. Wildcards are kept as they are.
+func (aliases Aliases) ResolveExpr(expr Expr) Expr {
+	switch e := expr.(type) {
+	case tagExpr:
+		if isWildcard(e.name) {
+			return e
+		}
+		return tagExpr{name: aliases.Resolve(e.name)}
+	case notExpr:
+		return notExpr{operand: aliases.ResolveExpr(e.operand)}
+	case andExpr:
+		return andExpr{left: aliases.ResolveExpr(e.left), right: aliases.ResolveExpr(e.right)}
+	case orExpr:
+		return orExpr{left: aliases.ResolveExpr(e.left), right: aliases.ResolveExpr(e.right)}
+	}
+	return expr
+}
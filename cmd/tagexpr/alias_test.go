@@ -0,0 +1,51 @@
+package tagexpr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	aliases := Aliases{"js": "javascript", "golang": "lang/go"}
+
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"js", "javascript"},
+		{"JS", "javascript"},
+		{"js/react", "javascript/react"},
+		{"javascript", "javascript"},
+		{"golang/std", "lang/go/std"},
+		{"jsx", "jsx"},
+	}
+
+	for _, tt := range tests {
+		if result := aliases.Resolve(tt.tag); result != tt.expected {
+			t.Errorf("Resolve(%q) = %q, want %q", tt.tag, result, tt.expected)
+		}
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	aliases := Aliases{"js": "javascript"}
+
+	want := []string{"javascript", "web"}
+	if have := aliases.ResolveAll([]string{"js", "javascript", "JS", "web"}); !reflect.DeepEqual(have, want) {
+		t.Errorf("ResolveAll() = %v, want %v", have, want)
+	}
+}
+
+func TestResolveExpr(t *testing.T) {
+	aliases := Aliases{"js": "javascript"}
+
+	expr, err := Parse("JS AND NOT (js/old OR j*)")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want := "(javascript AND NOT (javascript/old OR j*))"
+	if have := aliases.ResolveExpr(expr).String(); have != want {
+		t.Errorf("ResolveExpr() = %s, want %s", have, want)
+	}
+}
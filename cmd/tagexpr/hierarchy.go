@@ -0,0 +1,84 @@
+package tagexpr
+
+import "strings"
+
+// Separator splits a hierarchical tag into its levels, e.g. lang/go
+const Separator = "/"
+
+// Normalize trims the levels of a tag and drops empty ones, so " lang//go/ "
+// becomes "lang/go".
+func Normalize(tag string) string {
+	var levels []string
+	for _, level := range strings.Split(tag, Separator) {
+		if level = strings.TrimSpace(level); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return strings.Join(levels, Separator)
+}
+
+// Parent returns the tag one level up, or "" for a top level tag
+func Parent(tag string) string {
+	if i := strings.LastIndex(tag, Separator); i != -1 {
+		return tag[:i]
+	}
+	return ""
+}
+
+// Ancestors returns every tag above the given one, closest first: lang/go/std
+// has ancestors lang/go and lang.
+func Ancestors(tag string) []string {
+	var ancestors []string
+	for parent := Parent(tag); parent != ""; parent = Parent(parent) {
+		ancestors = append(ancestors, parent)
+	}
+	return ancestors
+}
+
+// Covers reports whether tag is the same as general or one of its descendants,
+// so a receiver tagged lang covers sources tagged lang/go.
+func Covers(general string, tag string) bool {
+	return tag == general || strings.HasPrefix(tag, general+Separator)
+}
+
+// Rename moves a tag, and its descendants, from one place in the hierarchy to
+// another: renaming lang/go to golang turns lang/go/std into golang/std. It
+// reports false when the tag is not covered by from. When to lies below from,
+// a tag already below to counts as renamed, so renaming lang to lang/go again
+// leaves lang/go alone instead of making lang/go/go.
+func Rename(tag string, from string, to string) (string, bool) {
+	if !Covers(from, tag) || (Covers(from, to) && Covers(to, tag)) {
+		return tag, false
+	}
+	return to + tag[len(from):], true
+}
+
+// RenameExpr renames the tags an expression refers to like Rename, with every
+// tag of from renamed to to. It reports whether anything changed. Wildcards
+// are kept as they are.
+func RenameExpr(expr Expr, from []string, to string) (Expr, bool) {
+	switch e := expr.(type) {
+	case tagExpr:
+		if isWildcard(e.name) {
+			return e, false
+		}
+		for _, f := range from {
+			if renamed, ok := Rename(e.name, f, to); ok {
+				return tagExpr{name: renamed}, true
+			}
+		}
+		return e, false
+	case notExpr:
+		operand, changed := RenameExpr(e.operand, from, to)
+		return notExpr{operand: operand}, changed
+	case andExpr:
+		left, leftChanged := RenameExpr(e.left, from, to)
+		right, rightChanged := RenameExpr(e.right, from, to)
+		return andExpr{left: left, right: right}, leftChanged || rightChanged
+	case orExpr:
+		left, leftChanged := RenameExpr(e.left, from, to)
+		right, rightChanged := RenameExpr(e.right, from, to)
+		return orExpr{left: left, right: right}, leftChanged || rightChanged
+	}
+	return expr, false
+}
@@ -0,0 +1,114 @@
+package tagexpr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"lang", "lang"},
+		{" lang//go/ ", "lang/go"},
+		{"/lang / go", "lang/go"},
+		{"///", ""},
+	}
+
+	for _, tt := range tests {
+		if result := Normalize(tt.tag); result != tt.expected {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.tag, result, tt.expected)
+		}
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	tests := []struct {
+		tag      string
+		expected []string
+	}{
+		{"lang", nil},
+		{"lang/go", []string{"lang"}},
+		{"lang/go/std", []string{"lang/go", "lang"}},
+	}
+
+	for _, tt := range tests {
+		if result := Ancestors(tt.tag); !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("Ancestors(%q) = %v, want %v", tt.tag, result, tt.expected)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		general  string
+		tag      string
+		expected bool
+	}{
+		{"lang", "lang", true},
+		{"lang", "lang/go", true},
+		{"lang", "lang/go/std", true},
+		{"lang/go", "lang", false},
+		{"lang", "language", false},
+		{"lang/go", "lang/golang", false},
+	}
+
+	for _, tt := range tests {
+		if result := Covers(tt.general, tt.tag); result != tt.expected {
+			t.Errorf("Covers(%q, %q) = %v, want %v", tt.general, tt.tag, result, tt.expected)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		tag, from, to string
+		expected      string
+		renamed       bool
+	}{
+		{"js", "js", "javascript", "javascript", true},
+		{"lang/go/std", "lang/go", "golang", "golang/std", true},
+		{"lang/golang", "lang/go", "golang", "lang/golang", false},
+		{"lang", "lang/go", "golang", "lang", false},
+		{"go", "go", "lang/go", "lang/go", true},
+		{"lang/rust", "lang", "lang/go", "lang/go/rust", true},
+		{"lang/go", "lang", "lang/go", "lang/go", false},
+		{"lang/go/std", "lang", "lang/go", "lang/go/std", false},
+	}
+
+	for _, tt := range tests {
+		result, renamed := Rename(tt.tag, tt.from, tt.to)
+		if result != tt.expected || renamed != tt.renamed {
+			t.Errorf("Rename(%q, %q, %q) = %q, %v; want %q, %v", tt.tag, tt.from, tt.to, result, renamed, tt.expected, tt.renamed)
+		}
+	}
+}
+
+func TestRenameExpr(t *testing.T) {
+	tests := []struct {
+		query   string
+		from    []string
+		to      string
+		want    string
+		changed bool
+	}{
+		{"js AND NOT (js/old OR j*)", []string{"js"}, "javascript", "(javascript AND NOT (javascript/old OR j*))", true},
+		{"work OR JS", []string{"js", "JS"}, "javascript", "(work OR javascript)", true},
+		{"lang AND lang/go", []string{"lang"}, "lang/go", "(lang/go AND lang/go)", true},
+		{"lang/go", []string{"lang"}, "lang/go", "lang/go", false},
+		{"work", []string{"js"}, "javascript", "work", false},
+	}
+
+	for _, tt := range tests {
+		expr, err := Parse(tt.query)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.query, err)
+		}
+
+		renamed, changed := RenameExpr(expr, tt.from, tt.to)
+		if renamed.String() != tt.want || changed != tt.changed {
+			t.Errorf("RenameExpr(%q, %v, %q) = %s, %v; want %s, %v", tt.query, tt.from, tt.to, renamed, changed, tt.want, tt.changed)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package tagexpr parses and evaluates boolean tag expressions such as
+// `work AND (rust OR go) AND NOT archived`.
+//
+// NOT binds tighter than AND, which binds tighter than OR. Operators are case
+// insensitive. Tags that contain spaces or parentheses, or that are spelled
+// like an operator, can be written between double quotes. A tag containing
+// * or ? is a wildcard, matched with path.Match against every tag.
+//
+// Tags are hierarchical: the term lang matches a folder tagged lang/go.
+package tagexpr
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Expr is a parsed tag expression
+type Expr interface {
+	// Matches reports whether a folder with the given tags satisfies the expression
+	Matches(tags []string) bool
+	String() string
+}
+
+type tagExpr struct {
+	name string
+}
+
+type notExpr struct {
+	operand Expr
+}
+
+type andExpr struct {
+	left, right Expr
+}
+
+type orExpr struct {
+	left, right Expr
+}
+
+func (e tagExpr) Matches(tags []string) bool {
+	for _, tag := range tags {
+		if e.matchesTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e tagExpr) matchesTag(tag string) bool {
+	if !isWildcard(e.name) {
+		return Covers(e.name, tag)
+	}
+
+	for _, candidate := range append([]string{tag}, Ancestors(tag)...) {
+		if matched, _ := path.Match(e.name, candidate); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func isWildcard(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+func (e notExpr) Matches(tags []string) bool {
+	return !e.operand.Matches(tags)
+}
+
+func (e andExpr) Matches(tags []string) bool {
+	return e.left.Matches(tags) && e.right.Matches(tags)
+}
+
+func (e orExpr) Matches(tags []string) bool {
+	return e.left.Matches(tags) || e.right.Matches(tags)
+}
+
+func (e tagExpr) String() string {
+	if e.name == "" || strings.ContainsAny(e.name, " \t\n()\"") || keyword(e.name) != "" {
+		return quote(e.name)
+	}
+	return e.name
+}
+
+// quote writes a tag the way tokenize reads a quoted one: everything up to the
+// next double quote, without escapes. Tags cannot contain a double quote.
+func quote(name string) string {
+	return `"` + name + `"`
+}
+
+func (e notExpr) String() string { return "NOT " + e.operand.String() }
+func (e andExpr) String() string { return "(" + e.left.String() + " AND " + e.right.String() + ")" }
+func (e orExpr) String() string  { return "(" + e.left.String() + " OR " + e.right.String() + ")" }
+
+// Reasons returns the terms without a NOT in front that a folder's tags
+// satisfy, in order of appearance in the expression. These are the tags a
+// matching folder is selected because of: the term lang for a folder tagged
+// lang/go, like a receiver tagged lang. A wildcard gives the level of the
+// folder's tag it matched, so lang/* gives lang/go for lang/go/std.
+func Reasons(expr Expr, tags []string) []string {
+	var reasons []string
+	collectReasons(expr, false, tags, &reasons)
+	return reasons
+}
+
+func collectReasons(expr Expr, negated bool, tags []string, reasons *[]string) {
+	switch e := expr.(type) {
+	case tagExpr:
+		if negated {
+			return
+		}
+		if !isWildcard(e.name) {
+			if e.Matches(tags) && !slices.Contains(*reasons, e.name) {
+				*reasons = append(*reasons, e.name)
+			}
+			return
+		}
+		for _, tag := range tags {
+			for _, candidate := range append([]string{tag}, Ancestors(tag)...) {
+				if matched, _ := path.Match(e.name, candidate); matched {
+					if !slices.Contains(*reasons, candidate) {
+						*reasons = append(*reasons, candidate)
+					}
+					break
+				}
+			}
+		}
+	case notExpr:
+		collectReasons(e.operand, !negated, tags, reasons)
+	case andExpr:
+		collectReasons(e.left, negated, tags, reasons)
+		collectReasons(e.right, negated, tags, reasons)
+	case orExpr:
+		collectReasons(e.left, negated, tags, reasons)
+		collectReasons(e.right, negated, tags, reasons)
+	}
+}
+
+// Parse parses a tag expression
+func Parse(input string) (Expr, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty tag expression")
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %s at position %d", p.peek(), p.peek().pos)
+	}
+
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokenTag tokenKind = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenTag {
+		return "tag " + quote(t.value)
+	}
+	return quote(t.value)
+}
+
+func keyword(word string) string {
+	switch strings.ToUpper(word) {
+	case "AND", "OR", "NOT":
+		return strings.ToUpper(word)
+	}
+	return ""
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpen, value: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenClose, value: ")", pos: i})
+			i++
+		case c == '"':
+			end := strings.IndexByte(input[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenTag, value: input[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(input) && !strings.ContainsRune(" \t\n()\"", rune(input[i])) {
+				i++
+			}
+			word := input[start:i]
+
+			kind := tokenTag
+			switch keyword(word) {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind: kind, value: word, pos: start})
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) accept(kind tokenKind) bool {
+	if !p.done() && p.peek().kind == kind {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// or := and ("OR" and)*
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenOr) {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// and := not ("AND" not)*
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(tokenAnd) {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// not := "NOT" not | primary
+func (p *parser) parseNot() (Expr, error) {
+	if p.accept(tokenNot) {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+// primary := tag | "(" or ")"
+func (p *parser) parsePrimary() (Expr, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of tag expression")
+	}
+
+	tok := p.peek()
+	switch tok.kind {
+	case tokenTag:
+		p.pos++
+		return tagExpr{name: tok.value}, nil
+	case tokenOpen:
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(tokenClose) {
+			return nil, fmt.Errorf("missing closing parenthesis for the one at position %d", tok.pos)
+		}
+		return expr, nil
+	default:
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+}
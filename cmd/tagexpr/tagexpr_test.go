@@ -0,0 +1,162 @@
+package tagexpr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"work", "work"},
+		{"work AND rust", "(work AND rust)"},
+		{"a OR b AND c", "(a OR (b AND c))"},
+		{"a AND b OR c", "((a AND b) OR c)"},
+		{"NOT a AND b", "(NOT a AND b)"},
+		{"NOT (a AND b)", "NOT (a AND b)"},
+		{"(a OR b) AND c", "((a OR b) AND c)"},
+		{"not not a", "NOT NOT a"},
+		{"work and rust or go", "((work AND rust) OR go)"},
+		{`"and" AND "my tag"`, `("and" AND "my tag")`},
+		{"a AND b AND c", "((a AND b) AND c)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			expr, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.input, err)
+			}
+			if expr.String() != tt.expected {
+				t.Errorf("Parse(%q) = %s, want %s", tt.input, expr.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	inputs := []string{
+		"",
+		"   ",
+		"AND",
+		"a AND",
+		"a OR OR b",
+		"(a",
+		"a)",
+		"a b",
+		"NOT",
+		`"unterminated`,
+		"()",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			if _, err := Parse(input); err == nil {
+				t.Errorf("Parse(%q) succeeded, expected an error", input)
+			}
+		})
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	names := []string{
+		`back\slash`,
+		`C:\`,
+		"café/naïve",
+		"日本語",
+		"my tag",
+		`C:\My Tags`,
+		"naïve tag ✓",
+		"it's",
+		"(paren)",
+		"or",
+		"Not",
+		"tab\there",
+		"",
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			expr := andExpr{left: notExpr{operand: tagExpr{name: name}}, right: tagExpr{name: name}}
+
+			parsed, err := Parse(expr.String())
+			if err != nil {
+				t.Fatalf("Parse(%s) failed: %v", expr.String(), err)
+			}
+			if !reflect.DeepEqual(parsed, Expr(expr)) {
+				t.Errorf("Parse(%s) = %#v, want %#v", expr.String(), parsed, expr)
+			}
+			if parsed.String() != expr.String() {
+				t.Errorf("Parse(%s).String() = %s", expr.String(), parsed.String())
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		expr     string
+		tags     []string
+		expected bool
+	}{
+		{"work", []string{"work"}, true},
+		{"work", []string{"fun"}, false},
+		{"work AND rust AND NOT archived", []string{"work", "rust"}, true},
+		{"work AND rust AND NOT archived", []string{"work", "rust", "archived"}, false},
+		{"work AND rust AND NOT archived", []string{"work"}, false},
+		{"go OR rust", []string{"rust"}, true},
+		{"go OR rust", []string{}, false},
+		{"NOT archived", []string{}, true},
+		{"(go OR rust) AND work", []string{"go", "work"}, true},
+		{"go OR rust AND work", []string{"go"}, true},
+		{"go*", []string{"golang"}, true},
+		{"go*", []string{"ergo"}, false},
+		{"?s", []string{"js", "ts"}, true},
+		{"lang/*", []string{"lang/go"}, true},
+		{"lang/*", []string{"lang"}, false},
+		{"work AND NOT arch*", []string{"work", "archived"}, false},
+		{"lang", []string{"lang/go"}, true},
+		{"lang/go", []string{"lang"}, false},
+		{"lang", []string{"language"}, false},
+		{"lan*", []string{"lang/go/std"}, true},
+		{"NOT archived", []string{"archived/2020"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.expr, err)
+			}
+			if result := expr.Matches(tt.tags); result != tt.expected {
+				t.Errorf("%s matches %v = %v, want %v", tt.expr, tt.tags, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReasons(t *testing.T) {
+	expr, err := Parse("work AND (rust OR go*) AND NOT archived AND NOT NOT pinned AND work")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tags := []string{"pinned", "golang", "archived", "work", "gopher"}
+
+	want := []string{"work", "golang", "gopher", "pinned"}
+	if have := Reasons(expr, tags); !reflect.DeepEqual(have, want) {
+		t.Errorf("Reasons() = %v, want %v", have, want)
+	}
+
+	expr, err = Parse("lang OR lang/* OR lang/go/std/more")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want = []string{"lang", "lang/go"}
+	if have := Reasons(expr, []string{"lang/go/std"}); !reflect.DeepEqual(have, want) {
+		t.Errorf("Reasons() for hierarchical tags = %v, want %v", have, want)
+	}
+}
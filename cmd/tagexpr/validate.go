@@ -0,0 +1,40 @@
+package tagexpr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxTagLength is the maximum length of a tag in bytes
+const MaxTagLength = 255
+
+// Validate checks that a normalised tag can be stored and queried. Tags may
+// contain any printable Unicode, including commas and spaces, but no control
+// characters, no double quotes and no wildcard characters.
+func Validate(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tag is empty")
+	}
+
+	if len(tag) > MaxTagLength {
+		return fmt.Errorf("tag %.20q... is longer than %d bytes", tag, MaxTagLength)
+	}
+
+	if !utf8.ValidString(tag) {
+		return fmt.Errorf("tag %q is not valid UTF-8", tag)
+	}
+
+	for _, r := range tag {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("tag %q contains a control character", tag)
+		}
+	}
+
+	if strings.ContainsAny(tag, `"*?[`) {
+		return fmt.Errorf(`tag %q contains one of the reserved characters " * ? [`, tag)
+	}
+
+	return nil
+}
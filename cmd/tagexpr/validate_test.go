@@ -0,0 +1,34 @@
+package tagexpr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		tag   string
+		valid bool
+	}{
+		{"work", true},
+		{"lang/go", true},
+		{"hello, world", true},
+		{"日本語", true},
+		{"c++", true},
+		{"", false},
+		{"tab\there", false},
+		{"nul\x00", false},
+		{"\xff", false},
+		{`say "hi"`, false},
+		{"go*", false},
+		{strings.Repeat("a", MaxTagLength), true},
+		{strings.Repeat("a", MaxTagLength+1), false},
+	}
+
+	for _, tt := range tests {
+		err := Validate(tt.tag)
+		if (err == nil) != tt.valid {
+			t.Errorf("Validate(%q) = %v, want valid %v", tt.tag, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// unionDirName is where a union receiver mounts its overlay. The union is not
+// mounted on the receiver itself, which would hide the receiver's own xattrs.
+const unionDirName = "merged"
+
+var unionWorkFlag string
+
+var unionCmd = &cobra.Command{
+	Use:   "union",
+	Short: "Manage union receivers",
+	Long: `Manage receivers with the '` + string(layoutUnion) + `' layout. A union receiver mounts one overlayfs
+at <receiver>/` + unionDirName + ` that merges all matching sources. When sources contain the same
+file, the one with the highest priority wins, ties go to the lowest path.
+
+Without an upper directory the union is read-only. With one, writes go to the upper
+directory and the sources are never changed. The union is rebuilt whenever the set
+of matching sources changes.`,
+}
+
+func init() {
+	priorityCmd := &cobra.Command{
+		Use:   "set-priority [flags] priority path",
+		Short: "Set the priority of a source in unions, higher wins (default 0)",
+		Args:  cobra.ExactArgs(2),
+		Run:   runUnionSetPriority,
+	}
+
+	upperCmd := &cobra.Command{
+		Use:   "set-upper [flags] upperdir path",
+		Short: "Make a union receiver writable, writes go to upperdir",
+		Args:  cobra.ExactArgs(2),
+		Run:   runUnionSetUpper,
+	}
+	upperCmd.Flags().StringVarP(&unionWorkFlag, "work", "w", "", "Empty work directory on the filesystem of upperdir (default: .<upperdir>.work next to it)")
+
+	clearUpperCmd := &cobra.Command{
+		Use:   "clear-upper [flags] path",
+		Short: "Make a union receiver read-only again",
+		Args:  cobra.ExactArgs(1),
+		Run:   runUnionClearUpper,
+	}
+
+	unionCmd.AddCommand(priorityCmd)
+	unionCmd.AddCommand(upperCmd)
+	unionCmd.AddCommand(clearUpperCmd)
+
+	rootCmd.AddCommand(unionCmd)
+}
+
+func runUnionSetPriority(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	priority, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatalf("Invalid priority %q: %v", args[0], err)
+	}
+
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	if priority == 0 {
+		if err := unix.Removexattr(path, semlinkPriorityXattrKey); err != nil && err != unix.ENODATA {
+			log.Fatalf("Failed to remove priority: %v", err)
+		}
+	} else {
+		setXattr(path, semlinkPriorityXattrKey, strconv.Itoa(priority))
+	}
+
+	triggerUpdate()
+}
+
+func runUnionSetUpper(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	upper, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	path, err := filepath.Abs(args[1])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	work := unionWorkFlag
+	if work == "" {
+		work = filepath.Join(filepath.Dir(upper), "."+filepath.Base(upper)+".work")
+	}
+	if work, err = filepath.Abs(work); err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	if upper == work || strings.HasPrefix(work, upper+"/") || strings.HasPrefix(upper, work+"/") {
+		log.Fatalf("The upper and work directories can not contain each other")
+	}
+	if strings.HasPrefix(upper, path+"/") || strings.HasPrefix(work, path+"/") {
+		log.Fatalf("The upper and work directories have to be outside the receiver")
+	}
+
+	setXattr(path, semlinkUpperXattrKey, upper)
+	setXattr(path, semlinkWorkXattrKey, work)
+
+	if verbose {
+		fmt.Printf("Writes to %s now go to %s\n", path, upper)
+	}
+
+	triggerUpdate()
+}
+
+func runUnionClearUpper(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	ensureIsReceiver(path)
+
+	for _, key := range []string{semlinkUpperXattrKey, semlinkWorkXattrKey} {
+		if err := unix.Removexattr(path, key); err != nil && err != unix.ENODATA {
+			log.Fatalf("Failed to remove upper directory: %v", err)
+		}
+	}
+
+	triggerUpdate()
+}
+
+// getSemlinkPriority returns the union priority of a source, 0 when it has none
+func getSemlinkPriority(path string) (int, error) {
+	value, err := getXattr(path, semlinkPriorityXattrKey)
+	if err != nil || value == "" {
+		return 0, err
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority %q", value)
+	}
+	return priority, nil
+}
+
+// getSemlinkUpper returns the upper and work directories of a union receiver,
+// empty when the union is read-only.
+func getSemlinkUpper(path string) (string, string, error) {
+	upper, err := getXattr(path, semlinkUpperXattrKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	work, err := getXattr(path, semlinkWorkXattrKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	if (upper == "") != (work == "") {
+		return "", "", fmt.Errorf("union needs both an upper and a work directory")
+	}
+
+	return upper, work, nil
+}
+
+// unionLink merges the sources into the one overlay of a union receiver. The
+// sources are ordered by priority, the first one is the top layer.
+func unionLink(receiver taggedFolder, sources []taggedFolder) (link, bool) {
+	var layers []taggedFolder
+	for _, source := range sources {
+		if source.path == receiver.path || len(receiver.matchingTags(source)) == 0 {
+			continue
+		}
+
+		// overlayfs uses : to separate layers and , to separate options
+		if strings.ContainsAny(source.path, ":,") {
+			log.Printf("Leaving %s out of union %s: overlayfs does not support : or , in paths", source.path, receiver.path)
+			continue
+		}
+
+		layers = append(layers, source)
+	}
+
+	if len(layers) == 0 {
+		return link{}, false
+	}
+
+	sort.SliceStable(layers, func(i, j int) bool { return layers[i].priority > layers[j].priority })
+
+	var lower []string
+	for _, layer := range layers {
+		lower = append(lower, layer.path)
+	}
+
+	l := link{
+		source:   strings.Join(lower, ":"),
+		target:   receiver.path,
+		virtual:  path.Join(receiver.path, unionDirName),
+		readOnly: receiver.mode == modeReadOnly,
+		backend:  receiver.backend,
+		lower:    lower,
+	}
+
+	// a read-only receiver ignores its upper directory
+	if !l.readOnly {
+		l.upper, l.work = receiver.upper, receiver.work
+	}
+
+	// overlayfs needs two lower layers without an upper directory, a single
+	// read-only layer is the same as a read-only bind mount of it
+	if len(lower) == 1 && l.upper == "" {
+		l.source, l.readOnly, l.lower = lower[0], true, nil
+	}
+
+	return l, true
+}
+
+// overlayBackend mounts the overlay of a union receiver. It is removed like a
+// bind mount.
+type overlayBackend struct {
+	bindMountBackend
+}
+
+func (o overlayBackend) link(l link) error {
+	if useMountHelper() {
+		return fmt.Errorf("failed to mount union at %s: the mount helper only makes bind mounts, unions need root", l.virtual)
+	}
+
+	if err := makeVirtualDirectory(l.target, l.virtual); err != nil {
+		return err
+	}
+
+	options := "lowerdir=" + strings.Join(l.lower, ":")
+	if l.upper != "" {
+		for _, dir := range []string{l.upper, l.work} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", dir, err)
+			}
+		}
+		options += ",upperdir=" + l.upper + ",workdir=" + l.work
+	}
+
+	var flags uintptr
+	if l.readOnly {
+		flags = unix.MS_RDONLY
+	}
+
+	if err := unix.Mount("overlay", l.virtual, "overlay", flags, options); err != nil {
+		return fmt.Errorf("failed to mount union of %s at %s: %w", l.source, l.virtual, err)
+	}
+
+	return nil
+}
+
+func (o overlayBackend) isLinkOf(l link) bool {
+	mount, ok := o.top[l.virtual]
+	if !ok || mount.fsType != "overlay" || mount.readOnly() != l.readOnly {
+		return false
+	}
+
+	lower, _ := mount.superOption("lowerdir")
+	upper, _ := mount.superOption("upperdir")
+	return lower == l.source && upper == l.upper
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnionLink(t *testing.T) {
+	sources := []taggedFolder{
+		{path: "/src/a", folderType: SOURCE, tags: []string{"fonts"}},
+		{path: "/src/b", folderType: SOURCE, tags: []string{"fonts"}, priority: 10},
+		{path: "/src/c", folderType: SOURCE, tags: []string{"fonts"}},
+		{path: "/src/d:e", folderType: SOURCE, tags: []string{"fonts"}},
+		{path: "/src/music", folderType: SOURCE, tags: []string{"music"}},
+	}
+	receiver := taggedFolder{path: "/recv/fonts", folderType: RECEIVER, tags: []string{"fonts"}, layout: layoutUnion, upper: "/up", work: "/work"}
+
+	l, ok := unionLink(receiver, sources)
+	if !ok {
+		t.Fatal("unionLink found no sources")
+	}
+
+	want := link{
+		source:  "/src/b:/src/a:/src/c",
+		target:  "/recv/fonts",
+		virtual: "/recv/fonts/" + unionDirName,
+		lower:   []string{"/src/b", "/src/a", "/src/c"},
+		upper:   "/up",
+		work:    "/work",
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("unionLink() = %+v, want %+v", l, want)
+	}
+
+	receiver.mode = modeReadOnly
+	if l, _ := unionLink(receiver, sources); !l.readOnly || l.upper != "" {
+		t.Errorf("read-only union kept its upper directory: %+v", l)
+	}
+
+	// a single layer without an upper directory can not be an overlay
+	single := []taggedFolder{sources[0], sources[4]}
+	want = link{source: "/src/a", target: "/recv/fonts", virtual: "/recv/fonts/" + unionDirName, readOnly: true}
+	if l, _ := unionLink(receiver, single); !reflect.DeepEqual(l, want) {
+		t.Errorf("unionLink() of one read-only layer = %+v, want %+v", l, want)
+	}
+
+	receiver.mode = modeReadWrite
+	receiver.upper, receiver.work = "", ""
+	if l, _ := unionLink(receiver, single); !reflect.DeepEqual(l, want) {
+		t.Errorf("unionLink() of one layer without upper = %+v, want %+v", l, want)
+	}
+
+	receiver.upper, receiver.work = "/up", "/work"
+	if l, _ := unionLink(receiver, single); l.lower == nil || l.readOnly {
+		t.Errorf("unionLink() of one layer with upper is not a writable overlay: %+v", l)
+	}
+
+	receiver.tags = []string{"video"}
+	if _, ok := unionLink(receiver, sources); ok {
+		t.Error("expected no union without matching sources")
+	}
+}
+
+func TestDesiredLinksWithUnion(t *testing.T) {
+	folders := []taggedFolder{
+		{path: "/src/a", folderType: SOURCE, tags: []string{"fonts"}},
+		{path: "/recv/flat", folderType: RECEIVER, tags: []string{"fonts"}},
+		{path: "/recv/fonts", folderType: RECEIVER, tags: []string{"fonts"}, layout: layoutUnion},
+		{path: "/recv/links", folderType: RECEIVER, tags: []string{"fonts"}, layout: layoutUnion, backend: backendSymlink},
+	}
+
+	links := desiredLinks(folders)
+
+	want := []link{
+		{source: "/src/a", target: "/recv/flat", tag: "fonts", virtual: "/recv/flat/a"},
+		{source: "/src/a", target: "/recv/fonts", virtual: "/recv/fonts/merged", readOnly: true},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("desiredLinks() = %+v, want %+v", links, want)
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/spf13/cobra"
+)
+
+var untagTags []string
+
+func init() {
+	untagCmd := &cobra.Command{
+		Use:   "untag [flags] path",
+		Short: "Remove tags from a directory",
+		Long: `Remove one or more tags from a directory's semlink xattr data.
+Virtual directories that were only mounted because of the removed tags are unmounted
+by the update that follows.`,
+		Args: cobra.ExactArgs(1),
+		Run:  runUntag,
+	}
+
+	untagCmd.Flags().StringSliceVarP(&untagTags, "tag", "t", []string{}, "Tags to remove (can be specified multiple times)")
+	untagCmd.MarkFlagRequired("tag")
+
+	rootCmd.AddCommand(untagCmd)
+}
+
+func runUntag(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Failed to resolve absolute path: %v", err)
+	}
+
+	existingTags, err := getSemlinkTags(path)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	aliases, err := repo.GetAliases()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// compare canonical tags, so untagging js also removes javascript
+	toRemove := aliases.ResolveAll(untagTags)
+
+	var remaining, removed []string
+	for _, tag := range existingTags {
+		if slices.Contains(toRemove, aliases.Resolve(tag)) {
+			removed = append(removed, tag)
+		} else if tag != "" {
+			remaining = append(remaining, tag)
+		}
+	}
+
+	if len(removed) == 0 {
+		fmt.Printf("None of the given tags are set on %s\n", path)
+		return
+	}
+
+	setSemlinkTags(path, remaining)
+
+	folder := repository.FolderInfo{FullPath: path}
+	if err := repo.RemoveTagsFromFolder(folder, removed); err != nil {
+		log.Fatalf("Could not remove tags from folder %s in the database: %v", path, err)
+	}
+
+	if verbose {
+		fmt.Printf("Successfully removed tags from %s\n", path)
+		fmt.Printf("Remaining tags: %s\n", strings.Join(remaining, ", "))
+	}
+
+	triggerUpdate()
+}
@@ -4,17 +4,16 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/Kaya-Sem/oopsie"
 	"github.com/Kaya-Sem/semlink/cmd/repository"
 	"golang.org/x/sys/unix"
 )
 
-//  TODO: add a command to trigger an update manually -> users can run it at startup to mount everything
-
 func triggerUpdate() {
 	if verbose {
 		fmt.Println("\nSynchronising database...")
@@ -26,91 +25,77 @@ func triggerUpdate() {
 		fmt.Printf("\n ⚙️Update triggered!\n")
 	}
 
-	/*  TODO: before mounting, attempt a repair (system Inode scan) */
+	if repo, err := repository.NewSqliteRepo(); err == nil {
+		warnAboutOrphans(repo)
+	}
 
-	// resolve_orphans()
-	// unmount_all()
-	mountDirectories()
-}
+	if mountsAreDeferred() {
+		fmt.Println("Rootless mode: the changes show up in 'semlink shell' and 'semlink exec'")
+		return
+	}
 
-func mountDirectories() {
+	mountDirectories(true)
+}
 
+// mountDirectories reconciles the mounted virtual directories with the
+// links described by the repository: missing links are mounted and links that
+// are no longer wanted are unmounted. The links table is only updated when
+// record is set.
+func mountDirectories(record bool) {
 	repo, err := repository.NewSqliteRepo()
 	if err != nil {
 		log.Fatalf("Failed to get repository: %v", err)
-		os.Exit(1)
 	}
 
-	folders, err := repo.GetAllFolders()
+	diff, err := computeMountDiff(repo)
 	if err != nil {
-		fmt.Printf(oopsie.CreateOopsie().IndicatorMessage("Database").Error(err).Render())
+		fmt.Print(oopsie.CreateOopsie().IndicatorMessage("Database").Error(err).Render())
 		os.Exit(1)
 	}
 
-	sourceMap := make(map[string][]string)
-	receiverMap := make(map[string][]string)
+	printMountDiff(diff)
 
-	for _, folder := range folders {
-		folderType, err := getSemlinkType(folder.FullPath)
-		if err != nil {
-			if verbose {
-				log.Printf("Could not get type for folder %s: %v", folder.FullPath, err)
-			}
-			continue
-		}
-
-		tags, err := getSemlinkTags(folder.FullPath)
-		if err != nil {
-			if verbose {
-				log.Printf("Could not get tags for folder %s: %v", folder.FullPath, err)
-			}
-			continue
-		}
-
-		if folderType == string(RECEIVER) {
-			for _, tag := range tags {
-				if _, ok := receiverMap[tag]; !ok { // tag present?
-					// If not, initialize it with a new slice
-					receiverMap[tag] = []string{}
-				}
-				// Add the folder path to the slice
-				receiverMap[tag] = append(receiverMap[tag], folder.FullPath)
-			}
-		} else if folderType == string(SOURCE) {
-			for _, tag := range tags {
-				if _, ok := sourceMap[tag]; !ok { // tag present?
-					// If not, initialize it with a new slice
-					sourceMap[tag] = []string{}
-				}
-				// Add the folder path to the slice
-				sourceMap[tag] = append(sourceMap[tag], folder.FullPath)
-			}
-		} else {
-			log.Printf("Unexpected type encountered for folder %s: %s", folder.FullPath, folderType)
-			continue
-		}
+	for _, err := range applyMountDiff(repo, diff, record) {
+		fmt.Printf("Error: %v\n", err)
 	}
+}
 
-	fmt.Println("Receiver Map:", receiverMap)
-	fmt.Println("Source Map:", sourceMap)
-
-	for tag, fileInfoSlice := range sourceMap {
-		targets := receiverMap[tag]
-
-		for _, sourcePath := range fileInfoSlice {
-			for _, targetPath := range targets {
-				err := linkFolder(sourcePath, targetPath)
+// computeMountDiff compares the links described by the repository and the
+// folders' xattrs with what is currently mounted.
+func computeMountDiff(repo *repository.SqliteRepo) (mountDiff, error) {
+	folders, err := loadTaggedFolders(repo)
+	if err != nil {
+		return mountDiff{}, err
+	}
 
-				if err != nil {
-					fmt.Printf("Error: %v", err)
+	return planMountDiff(repo, folders)
+}
 
-				}
+// planMountDiff compares the links wanted by the already loaded folders with
+// what is currently mounted.
+func planMountDiff(repo *repository.SqliteRepo, folders []taggedFolder) (mountDiff, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return mountDiff{}, err
+	}
 
-			}
-		}
+	links, err := repo.GetAllLinks()
+	if err != nil {
+		return mountDiff{}, err
+	}
 
+	tracked := trackedLinks(links)
+	desired := desiredLinks(folders)
+	owned := ownedMounts(mounts, receiverPaths(folders), tracked, isVirtualDirectory)
+	for virtual, count := range ownedSymlinks(tracked) {
+		owned[virtual] += count
 	}
 
+	// a link with the wrong mode or backend is replaced like one of the wrong source
+	top := topMounts(mounts)
+	return planMounts(desired, owned, tracked, func(l link) bool {
+		return newLinkBackend(l, top).isLinkOf(l)
+	}), nil
 }
 
 func logFatalWithCaller(msg string, err error) {
@@ -136,39 +121,101 @@ func trimFunctionName(funcName string) string {
 	return funcName
 }
 
-// TODO: a linked folder should be set in the database
-func linkFolder(source string, target string) error {
-	// Extract the last piece of the target path (the last folder name)
-	subDir := path.Join(target, path.Base(source))
+// makeVirtualDirectory creates the subdirectory of a receiver, together with
+// the folders between them that a naming template like '{tag}/{base}' needs.
+// Every folder it creates is marked virtual, so it is removed again with the
+// last virtual directory inside it.
+func makeVirtualDirectory(receiver string, subDir string) error {
+	var missing []string
+	for dir := subDir; dir != receiver && strings.HasPrefix(dir, receiver+"/"); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
 
-	// Create the subdirectory in the target folder
-	err := os.MkdirAll(subDir, 0755) // Create target subdirectory if it doesn't exist
-	if err != nil {
-		return fmt.Errorf("failed to create subdirectory %s: %w", subDir, err)
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create subdirectory %s: %w", missing[i], err)
+		}
 	}
 
-	err = setType(subDir, VIRTUAL)
+	for _, dir := range missing {
+		if err := setType(dir, VIRTUAL); err != nil {
+			return fmt.Errorf("failed to set type %s on %s", VIRTUAL, dir)
+		}
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to set type %s on %s", VIRTUAL, subDir)
+	// an existing subdirectory is marked as well, it may be left over from an older version
+	if len(missing) == 0 {
+		if err := setType(subDir, VIRTUAL); err != nil {
+			return fmt.Errorf("failed to set type %s on %s", VIRTUAL, subDir)
+		}
 	}
 
-	// Bind mount the source folder to the subdirectory in the target folder
-	err = unix.Mount(source, subDir, "", unix.MS_BIND, "")
-	if err != nil {
-		return fmt.Errorf("failed to bind mount %s to %s: %w", source, subDir, err)
+	return nil
+}
+
+// removeVirtualDirectory removes an unmounted virtual directory. Only empty
+// directories are removed, so the contents of a source are never touched.
+// Parents that were created for it and are empty now are removed as well.
+func removeVirtualDirectory(subDir string) error {
+	err := os.Remove(subDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove virtual directory %s: %w", subDir, err)
+	}
+
+	for dir := filepath.Dir(subDir); dir != "/"; dir = filepath.Dir(dir) {
+		folderType, err := getSemlinkType(dir)
+		if err != nil || Type(folderType) != VIRTUAL || os.Remove(dir) != nil {
+			break
+		}
 	}
 
 	return nil
 }
 
+// statFolder identifies the folder at path by its device and inode
+func statFolder(path string) (repository.FolderInfo, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return repository.FolderInfo{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	return repository.FolderInfo{Device: uint64(stat.Dev), Inode: stat.Ino, FullPath: path}, nil
+}
+
+// isPrivileged reports whether semlink can mount, see checkMountPermission
 func isPrivileged() bool {
-	return os.Geteuid() == 0
+	return mountPermission() == nil
 }
 
+// ensureIsPrivileged stops semlink when it needs to mount and can not. Only
+// bind mounts need privileges, so every user passes when the global backend is
+// symlink, or in rootless mode, where the mounts are made in a namespace.
 func ensureIsPrivileged() {
-	if !isPrivileged() {
-		fmt.Print(oopsie.CreateOopsie().Title("Invalid Permissions").Error(fmt.Errorf("semlink needs privileges to function. Please run with sudo, doas or as root.")).Render())
+	if !globalBackendNeedsPrivileges() || rootlessEnabled() {
+		return
+	}
+	ensureCanMount()
+}
+
+// ensureCanMount stops semlink when it can not mount, itself or through the
+// mount helper, whatever the backend, and explains what is missing.
+func ensureCanMount() {
+	if err := mountPermission(); err != nil && !mountHelperAvailable() {
+		fmt.Print(oopsie.CreateOopsie().Title("Invalid Permissions").Error(fmt.Errorf("semlink can not mount: %v. Please run with sudo, doas or as root, start 'semlink mount-helper' as root, or see 'semlink rootless --help'.", err)).Render())
 		os.Exit(1)
 	}
 }
+
+// globalBackendNeedsPrivileges is looked up once, setType asks for every directory
+var globalBackendNeedsPrivileges = sync.OnceValue(func() bool {
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		return true
+	}
+
+	backend, err := globalBackend(repo)
+	return err != nil || backend.needsPrivileges()
+})
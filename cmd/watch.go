@@ -0,0 +1,557 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/Kaya-Sem/semlink/cmd/repository"
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// folderWatchMask catches xattr changes and the folder itself moving or going away
+const folderWatchMask = unix.IN_ATTRIB | unix.IN_MOVE_SELF | unix.IN_DELETE_SELF | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// databaseWatchMask catches writes to the database, e.g. by 'semlink add'
+const databaseWatchMask = unix.IN_MODIFY | unix.IN_CREATE | unix.IN_MOVED_TO
+
+var (
+	watchDebounceFlag time.Duration
+	watchRoots        []string
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Keep the mounts up to date while folders change",
+	Long: `Watch every registered folder and the database. When the user.semlink xattrs of a
+folder change, e.g. through setfattr, the database is updated and only the mounts of
+that folder are reconciled. Moved folders are looked up next to their old place and in
+the given roots, deleted folders are removed from the database. Folders registered
+while watching are picked up through the database.
+
+Events are collected until nothing happens for the debounce time. Runs until it is
+interrupted.`,
+	Args: cobra.NoArgs,
+	Run:  runWatch,
+}
+
+func init() {
+	watchCmd.Flags().DurationVarP(&watchDebounceFlag, "debounce", "d", 500*time.Millisecond, "Wait this long after the last event before reconciling")
+	watchCmd.Flags().StringSliceVarP(&watchRoots, "root", "r", []string{}, "Directories to search for moved folders (default: your home directory)")
+	watchCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
+
+	rootCmd.AddCommand(watchCmd)
+}
+
+func runWatch(cmd *cobra.Command, args []string) {
+	ensureIsPrivileged()
+
+	if mountsAreDeferred() {
+		log.Fatalf("In rootless mode the virtual directories are only mounted by 'semlink shell' and 'semlink exec'")
+	}
+
+	repo, err := repository.NewSqliteRepo()
+	if err != nil {
+		log.Fatalf("Failed to get repository: %v", err)
+	}
+
+	roots := watchRoots
+	if len(roots) == 0 {
+		roots = []string{repository.HomeDir()}
+	}
+
+	w, err := newFolderWatcher(repo, roots)
+	if err != nil {
+		log.Fatalf("Failed to start watching: %v", err)
+	}
+	defer unix.Close(w.fd)
+
+	// the first batch loads every folder and reconciles everything
+	w.apply(watchBatch{overflow: true})
+	fmt.Printf("Watching %d folders\n", len(w.watches))
+
+	if err := w.run(watchDebounceFlag); err != nil {
+		log.Fatalf("Stopped watching: %v", err)
+	}
+}
+
+// folderWatcher keeps the loaded folders in sync with their xattrs
+type folderWatcher struct {
+	repo          *repository.SqliteRepo
+	roots         []string
+	fd            int
+	databaseWatch int32
+
+	watches map[int32]repository.FolderInfo
+	paths   map[string]int32
+	folders map[string]taggedFolder // by path, left out folders are missing
+	dbTags  map[string][]string     // tags the database has for a folder
+}
+
+func newFolderWatcher(repo *repository.SqliteRepo, roots []string) (*folderWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify instance: %w", err)
+	}
+
+	databaseDir := filepath.Dir(repository.DatabaseFile())
+	wd, err := unix.InotifyAddWatch(fd, databaseDir, databaseWatchMask)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", databaseDir, err)
+	}
+
+	return &folderWatcher{
+		repo:          repo,
+		roots:         roots,
+		fd:            fd,
+		databaseWatch: int32(wd),
+		watches:       make(map[int32]repository.FolderInfo),
+		paths:         make(map[string]int32),
+		folders:       make(map[string]taggedFolder),
+		dbTags:        make(map[string][]string),
+	}, nil
+}
+
+// watchBatch collects the events of one debounce period
+type watchBatch struct {
+	changed  map[int32]bool // xattrs or other attributes changed
+	moved    map[int32]bool
+	deleted  map[int32]bool // deleted, or no longer watched for another reason
+	database bool
+	overflow bool // events were lost, everything has to be checked
+}
+
+func (batch watchBatch) isEmpty() bool {
+	return len(batch.changed) == 0 && len(batch.moved) == 0 && len(batch.deleted) == 0 && !batch.database && !batch.overflow
+}
+
+type inotifyEvent struct {
+	wd   int32
+	mask uint32
+	name string
+}
+
+// parseInotifyEvents splits what one read of an inotify descriptor returned
+func parseInotifyEvents(buf []byte) []inotifyEvent {
+	var events []inotifyEvent
+
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		end := offset + unix.SizeofInotifyEvent + int(raw.Len)
+		if end > len(buf) {
+			break
+		}
+
+		name := strings.TrimRight(string(buf[offset+unix.SizeofInotifyEvent:end]), "\x00")
+		events = append(events, inotifyEvent{wd: raw.Wd, mask: raw.Mask, name: name})
+		offset = end
+	}
+
+	return events
+}
+
+func (w *folderWatcher) run(debounce time.Duration) error {
+	events := make(chan []inotifyEvent)
+	errs := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := unix.Read(w.fd, buf)
+			if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				errs <- err
+				return
+			}
+			events <- parseInotifyEvents(buf[:n])
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	batch := newWatchBatch()
+	var settled <-chan time.Time
+	for {
+		select {
+		case received := <-events:
+			for _, event := range received {
+				w.collect(&batch, event)
+			}
+			if !batch.isEmpty() {
+				settled = time.After(debounce)
+			}
+
+		case <-settled:
+			w.apply(batch)
+			batch = newWatchBatch()
+			settled = nil
+
+		case err := <-errs:
+			return err
+
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+func newWatchBatch() watchBatch {
+	return watchBatch{changed: make(map[int32]bool), moved: make(map[int32]bool), deleted: make(map[int32]bool)}
+}
+
+func (w *folderWatcher) collect(batch *watchBatch, event inotifyEvent) {
+	switch {
+	case event.mask&unix.IN_Q_OVERFLOW != 0:
+		batch.overflow = true
+	case event.wd == w.databaseWatch:
+		// sqlite also writes a journal next to the database
+		if strings.HasPrefix(event.name, filepath.Base(repository.DatabaseFile())) {
+			batch.database = true
+		}
+	case event.mask&(unix.IN_DELETE_SELF|unix.IN_IGNORED) != 0:
+		batch.deleted[event.wd] = true
+	case event.mask&unix.IN_MOVE_SELF != 0:
+		batch.moved[event.wd] = true
+	case event.mask&unix.IN_ATTRIB != 0:
+		batch.changed[event.wd] = true
+	}
+}
+
+// apply updates the database for the batch and reconciles the mounts of the
+// folders that changed.
+func (w *folderWatcher) apply(batch watchBatch) {
+	changed := make(map[string]bool)
+
+	w.applyMoves(batch, changed)
+	leftovers := w.applyDeletes(batch, changed)
+
+	for wd := range batch.changed {
+		folder, ok := w.watches[wd]
+		if !ok || batch.deleted[wd] {
+			continue
+		}
+
+		if err := w.syncTags(folder); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		w.reload(folder, changed)
+	}
+
+	if batch.database || batch.overflow {
+		if err := w.reloadAll(changed, batch.overflow); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	w.reconcile(changed)
+
+	for _, virtual := range leftovers {
+		if isVirtualDirectory(virtual) {
+			if err := removeVirtualDirectory(virtual); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		}
+	}
+}
+
+func (w *folderWatcher) applyMoves(batch watchBatch, changed map[string]bool) {
+	if len(batch.moved) == 0 {
+		return
+	}
+
+	var folders []repository.FolderInfo
+	for _, folder := range w.watches {
+		folders = append(folders, folder)
+	}
+
+	// bind mounts show their source's inode, never search inside them
+	skip, err := virtualDirectories(w.repo, folders)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	for wd := range batch.moved {
+		folder, ok := w.watches[wd]
+		if !ok || batch.deleted[wd] {
+			continue
+		}
+		changed[folder.FullPath] = true
+
+		newPath, found := w.findMoved(folder, skip)
+		if !found {
+			fmt.Printf("missing: %s was moved outside %s, run 'semlink repair --root <dir>'\n", folder.FullPath, strings.Join(w.roots, ", "))
+			continue
+		}
+
+		moved, err := statFolder(newPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+
+		if err := w.repo.UpdateFolder(folder, moved); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		fmt.Printf("moved:   %s -> %s\n", folder.FullPath, newPath)
+
+		// the watch follows the inode, only the path changes
+		tags := w.dbTags[folder.FullPath]
+		w.forget(folder.FullPath)
+		w.watches[wd] = moved
+		w.paths[moved.FullPath] = wd
+		w.dbTags[moved.FullPath] = tags
+		w.reload(moved, changed)
+	}
+}
+
+// findMoved looks for the folder next to its old place first, most moves are renames
+func (w *folderWatcher) findMoved(folder repository.FolderInfo, skip map[string]bool) (string, bool) {
+	parent := filepath.Dir(folder.FullPath)
+	if entries, err := os.ReadDir(parent); err == nil {
+		for _, entry := range entries {
+			path := filepath.Join(parent, entry.Name())
+			if !entry.IsDir() || skip[path] {
+				continue
+			}
+
+			var stat unix.Stat_t
+			if err := unix.Lstat(path, &stat); err == nil && uint64(stat.Dev) == folder.Device && stat.Ino == folder.Inode {
+				return path, true
+			}
+		}
+	}
+
+	found := searchRoots(w.roots, []repository.FolderInfo{folder}, skip)
+	path, ok := found[fileID{device: folder.Device, inode: folder.Inode}]
+	return path, ok
+}
+
+// applyDeletes removes deleted folders from the database. Their links go with
+// them, so it returns the virtual directories that may be left behind.
+func (w *folderWatcher) applyDeletes(batch watchBatch, changed map[string]bool) []string {
+	var leftovers []string
+
+	for wd := range batch.deleted {
+		folder, ok := w.watches[wd]
+		if !ok {
+			continue
+		}
+		delete(w.watches, wd)
+
+		// the watch can also end without the folder going away, e.g. on unmount
+		if current, err := statFolder(folder.FullPath); err == nil && current.Device == folder.Device && current.Inode == folder.Inode {
+			delete(w.paths, folder.FullPath)
+			w.watch(folder)
+			continue
+		}
+
+		links, err := w.repo.GetAllLinks()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		for _, l := range links {
+			if l.Source == folder.FullPath || slices.Contains(l.Layers, folder.FullPath) {
+				leftovers = append(leftovers, l.VirtualPath)
+			}
+		}
+
+		if err := w.repo.RemoveFolder(folder); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		fmt.Printf("removed: %s\n", folder.FullPath)
+
+		w.forget(folder.FullPath)
+		changed[folder.FullPath] = true
+	}
+
+	return leftovers
+}
+
+// syncTags stores the tags of the folder's xattr in the database
+func (w *folderWatcher) syncTags(folder repository.FolderInfo) error {
+	xattrTags, err := getSemlinkTags(folder.FullPath)
+	if err != nil {
+		return err
+	}
+
+	var tags []string
+	for _, tag := range xattrTags {
+		if err := tagexpr.Validate(tag); err != nil {
+			log.Printf("Ignoring tag of %s: %v", folder.FullPath, err)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	stored := w.dbTags[folder.FullPath]
+	var added, removed []string
+	for _, tag := range tags {
+		if !slices.Contains(stored, tag) {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range stored {
+		if !slices.Contains(tags, tag) {
+			removed = append(removed, tag)
+		}
+	}
+
+	if len(added) > 0 {
+		if err := w.repo.AddTagsToFolder(folder, added); err != nil {
+			return fmt.Errorf("could not add tags to folder %s in the database: %w", folder.FullPath, err)
+		}
+	}
+	if len(removed) > 0 {
+		if err := w.repo.RemoveTagsFromFolder(folder, removed); err != nil {
+			return fmt.Errorf("could not remove tags from folder %s in the database: %w", folder.FullPath, err)
+		}
+	}
+
+	w.dbTags[folder.FullPath] = tags
+	return nil
+}
+
+// reload rereads the xattrs of one folder and marks it changed when they differ
+func (w *folderWatcher) reload(folder repository.FolderInfo, changed map[string]bool) {
+	aliases, err := w.repo.GetAliases()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fallbackBackend, err := globalBackend(w.repo)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	w.update(folder, aliases, fallbackBackend, changed)
+}
+
+func (w *folderWatcher) update(folder repository.FolderInfo, aliases tagexpr.Aliases, fallbackBackend backendKind, changed map[string]bool) {
+	previous, had := w.folders[folder.FullPath]
+	loaded, ok := loadTaggedFolder(folder, aliases, fallbackBackend)
+
+	switch {
+	case ok && (!had || !reflect.DeepEqual(previous, loaded)):
+		w.folders[folder.FullPath] = loaded
+		changed[folder.FullPath] = true
+	case !ok && had:
+		delete(w.folders, folder.FullPath)
+		changed[folder.FullPath] = true
+	}
+}
+
+// reloadAll follows the database: folders are watched or forgotten, and every
+// folder is reread since aliases or the global backend may have changed.
+func (w *folderWatcher) reloadAll(changed map[string]bool, everything bool) error {
+	folders, err := w.repo.GetAllFolders()
+	if err != nil {
+		return err
+	}
+
+	aliases, err := w.repo.GetAliases()
+	if err != nil {
+		return err
+	}
+
+	fallbackBackend, err := globalBackend(w.repo)
+	if err != nil {
+		return err
+	}
+
+	registered := make(map[string]bool)
+	for _, folder := range folders {
+		registered[folder.FullPath] = true
+		if _, watched := w.paths[folder.FullPath]; !watched {
+			w.watch(folder)
+		}
+		w.dbTags[folder.FullPath] = folder.Tags()
+
+		w.update(folder, aliases, fallbackBackend, changed)
+		if everything {
+			changed[folder.FullPath] = true
+		}
+	}
+
+	for path, wd := range w.paths {
+		if !registered[path] {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+			w.forget(path)
+			changed[path] = true
+		}
+	}
+
+	return nil
+}
+
+func (w *folderWatcher) watch(folder repository.FolderInfo) {
+	wd, err := unix.InotifyAddWatch(w.fd, folder.FullPath, folderWatchMask)
+	if err != nil {
+		if verbose {
+			log.Printf("Not watching %s: %v", folder.FullPath, err)
+		}
+		return
+	}
+
+	w.watches[int32(wd)] = folder
+	w.paths[folder.FullPath] = int32(wd)
+}
+
+// forget drops everything known about the path, but not its watch
+func (w *folderWatcher) forget(path string) {
+	delete(w.paths, path)
+	delete(w.folders, path)
+	delete(w.dbTags, path)
+}
+
+// reconcile applies the part of the mount diff that involves the changed folders
+func (w *folderWatcher) reconcile(changed map[string]bool) {
+	var folders []taggedFolder
+	for _, folder := range w.folders {
+		folders = append(folders, folder)
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].path < folders[j].path })
+
+	diff, err := planMountDiff(w.repo, folders)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	links, err := w.repo.GetAllLinks()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	diff = diff.affecting(changed, links)
+	printMountDiff(diff)
+
+	for _, err := range applyMountDiff(w.repo, diff, true) {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawInotifyEvent encodes an event the way the kernel returns it, the name
+// padded with NULs.
+func rawInotifyEvent(wd int32, mask uint32, name string, padded int) []byte {
+	buf := make([]byte, unix.SizeofInotifyEvent+padded)
+	binary.NativeEndian.PutUint32(buf[0:], uint32(wd))
+	binary.NativeEndian.PutUint32(buf[4:], mask)
+	binary.NativeEndian.PutUint32(buf[12:], uint32(padded))
+	copy(buf[unix.SizeofInotifyEvent:], name)
+	return buf
+}
+
+func TestParseInotifyEvents(t *testing.T) {
+	var buf []byte
+	buf = append(buf, rawInotifyEvent(1, unix.IN_ATTRIB, "", 0)...)
+	buf = append(buf, rawInotifyEvent(2, unix.IN_MODIFY, "semlink.sqlite", 16)...)
+	buf = append(buf, rawInotifyEvent(3, unix.IN_MOVE_SELF, "", 0)...)
+
+	want := []inotifyEvent{
+		{wd: 1, mask: unix.IN_ATTRIB},
+		{wd: 2, mask: unix.IN_MODIFY, name: "semlink.sqlite"},
+		{wd: 3, mask: unix.IN_MOVE_SELF},
+	}
+	if got := parseInotifyEvents(buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseInotifyEvents = %+v, want %+v", got, want)
+	}
+
+	// a truncated event is dropped instead of read past the buffer
+	truncated := rawInotifyEvent(4, unix.IN_MODIFY, "semlink.sqlite", 16)[:unix.SizeofInotifyEvent+4]
+	if got := parseInotifyEvents(truncated); len(got) != 0 {
+		t.Errorf("parseInotifyEvents(truncated) = %+v, want nothing", got)
+	}
+}
+
+func TestWatchCollect(t *testing.T) {
+	w := &folderWatcher{databaseWatch: 1}
+	batch := newWatchBatch()
+
+	w.collect(&batch, inotifyEvent{wd: 1, mask: unix.IN_MODIFY, name: "other.txt"})
+	if !batch.isEmpty() {
+		t.Errorf("unrelated file in the database directory started a batch")
+	}
+
+	w.collect(&batch, inotifyEvent{wd: 1, mask: unix.IN_MODIFY, name: "semlink.sqlite-journal"})
+	w.collect(&batch, inotifyEvent{wd: 2, mask: unix.IN_ATTRIB})
+	w.collect(&batch, inotifyEvent{wd: 3, mask: unix.IN_MOVE_SELF})
+	w.collect(&batch, inotifyEvent{wd: 4, mask: unix.IN_DELETE_SELF})
+	w.collect(&batch, inotifyEvent{wd: 4, mask: unix.IN_IGNORED})
+
+	if !batch.database || !batch.changed[2] || !batch.moved[3] || !batch.deleted[4] || batch.overflow {
+		t.Errorf("collected %+v", batch)
+	}
+
+	w.collect(&batch, inotifyEvent{wd: -1, mask: unix.IN_Q_OVERFLOW})
+	if !batch.overflow {
+		t.Errorf("overflow was not collected")
+	}
+}
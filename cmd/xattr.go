@@ -3,8 +3,10 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 
+	"github.com/Kaya-Sem/semlink/cmd/tagexpr"
 	"golang.org/x/sys/unix"
 )
 
@@ -18,18 +20,32 @@ func setXattr(path string, semlinkXattrKey string, value string) {
 }
 
 func getXattr(path string, semlinkXattrKey string) (string, error) {
-	value := make([]byte, 1024)
-	vLen, err := unix.Getxattr(path, semlinkXattrKey, value)
-	if err != nil {
+	for {
+		// Probe the size first, the value can be of any length
+		size, err := unix.Getxattr(path, semlinkXattrKey, nil)
 		if err == unix.ENODATA {
 			// Key not found
 			return "", nil
 		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get xattr value for %s: %w", path, err)
+		}
+
+		value := make([]byte, size)
+		vLen, err := unix.Getxattr(path, semlinkXattrKey, value)
+		if err == unix.ERANGE {
+			// The value grew between probing and reading
+			continue
+		}
+		if err == unix.ENODATA {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get xattr value for %s: %w", path, err)
+		}
 
-		return "", fmt.Errorf("failed to get xattr value for %s: %w", path, err)
+		return string(value[:vLen]), nil
 	}
-	rawValue := string(value[:vLen])
-	return rawValue, nil
 }
 
 func getSemlinkType(path string) (string, error) {
@@ -49,20 +65,87 @@ func getSemlinkTags(path string) ([]string, error) {
 		return nil, err
 	}
 
-	tags := parseTags(tagString)
+	tags := decodeTags(tagString)
+	if tagString != "" && tagString[0] != tagEncodingV1 {
+		tags = validLegacyTags(path, tags)
+	}
 
 	return tags, nil
 }
 
+// validLegacyTags drops the legacy tags that do not pass validation, with a
+// warning, so the next write upgrades the folder instead of failing on them.
+func validLegacyTags(path string, tags []string) []string {
+	valid := []string{}
+	for _, tag := range tags {
+		if err := tagexpr.Validate(tag); err != nil {
+			log.Printf("Warning: ignoring a legacy tag of %s: %v", path, err)
+			continue
+		}
+		valid = append(valid, tag)
+	}
+	return valid
+}
+
+// setSemlinkTags stores the tags in the current encoding
+func setSemlinkTags(path string, tags []string) {
+	setXattr(path, semlinkTagXattrKey, encodeTags(tags))
+}
+
+// tagEncodingV1 starts a tag xattr value of version 1: the tags follow
+// separated by NUL bytes. Values without a version byte are in the legacy
+// comma separated format.
+const tagEncodingV1 = '\x01'
+
+func encodeTags(tags []string) string {
+	return string(tagEncodingV1) + strings.Join(tags, "\x00")
+}
+
+func decodeTags(value string) []string {
+	if value == "" || value[0] != tagEncodingV1 {
+		return parseTags(value)
+	}
+
+	tags := []string{}
+	for _, tag := range strings.Split(value[1:], "\x00") {
+		if tag = tagexpr.Normalize(tag); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// getSemlinkQuery returns the parsed query of a receiver, or nil when it has none
+func getSemlinkQuery(path string) (tagexpr.Expr, error) {
+	queryString, err := getXattr(path, semlinkQueryXattrKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(queryString) == "" {
+		return nil, nil
+	}
+
+	query, err := tagexpr.Parse(queryString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %w", queryString, err)
+	}
+
+	return query, nil
+}
+
+// parseTags reads the legacy comma separated format
 func parseTags(tagString string) []string {
 	if tagString == "" {
 		return []string{}
 	}
 
-	// Split the string by comma and trim spaces
-	tags := strings.Split(tagString, ",")
-	for i, tag := range tags {
-		tags[i] = strings.TrimSpace(tag)
+	// Split the string by comma and normalise every tag
+	tags := []string{}
+	for _, tag := range strings.Split(tagString, ",") {
+		if tag = tagexpr.Normalize(tag); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
 	return tags
 }
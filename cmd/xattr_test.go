@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		tagString string
+		expected  []string
+	}{
+		{"", []string{}},
+		{"work", []string{"work"}},
+		{"work, rust ,go", []string{"work", "rust", "go"}},
+		{"work,,  ,go", []string{"work", "go"}},
+		{" , ", []string{}},
+		{"lang//go/ , /lang", []string{"lang/go", "lang"}},
+	}
+
+	for _, tt := range tests {
+		if result := parseTags(tt.tagString); !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("parseTags(%q) = %v, want %v", tt.tagString, result, tt.expected)
+		}
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	tags := []string{"hello, world", "lang/go", "日本語"}
+
+	encoded := encodeTags(tags)
+	if encoded[0] != tagEncodingV1 {
+		t.Errorf("encoded value does not start with the version byte: %q", encoded)
+	}
+
+	if decoded := decodeTags(encoded); !reflect.DeepEqual(decoded, tags) {
+		t.Errorf("decodeTags(encodeTags(%v)) = %v", tags, decoded)
+	}
+}
+
+func TestDecodeTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{"empty", "", []string{}},
+		{"legacy", "work, rust", []string{"work", "rust"}},
+		{"v1", "\x01work\x00hello, world", []string{"work", "hello, world"}},
+		{"v1 empty", "\x01", []string{}},
+		{"v1 blank and duplicate tags", "\x01work\x00 \x00\x00work", []string{"work"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := decodeTags(tt.value); !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("decodeTags(%q) = %v, want %v", tt.value, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetXattrLongValue(t *testing.T) {
+	dir := t.TempDir()
+
+	// longer than the fixed buffer getXattr used to have
+	var tags []string
+	for i := 0; i < 200; i++ {
+		tags = append(tags, strings.Repeat("x", 10)+string(rune('a'+i%26))+strconv.Itoa(i))
+	}
+
+	setSemlinkTags(dir, tags)
+
+	result, err := getSemlinkTags(dir)
+	if err != nil {
+		t.Fatalf("getSemlinkTags failed: %v", err)
+	}
+	if !reflect.DeepEqual(result, tags) {
+		t.Errorf("read %d tags, want %d", len(result), len(tags))
+	}
+
+	missing, err := getXattr(dir, semlinkQueryXattrKey)
+	if err != nil || missing != "" {
+		t.Errorf("getXattr of a missing key = %q, %v; want empty", missing, err)
+	}
+}
+
+func TestGetSemlinkTagsInvalidLegacy(t *testing.T) {
+	dir := t.TempDir()
+
+	// written by an old version, before tag names were validated
+	setXattr(dir, semlinkTagXattrKey, `work, "quoted", go*, rust`)
+
+	result, err := getSemlinkTags(dir)
+	if err != nil {
+		t.Fatalf("getSemlinkTags failed: %v", err)
+	}
+	if want := []string{"work", "rust"}; !reflect.DeepEqual(result, want) {
+		t.Errorf("getSemlinkTags() = %v, want %v", result, want)
+	}
+}
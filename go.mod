@@ -4,6 +4,7 @@ go 1.23.4
 
 require (
 	github.com/Kaya-Sem/oopsie v1.0.0
+	github.com/hanwen/go-fuse/v2 v2.9.0
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/spf13/cobra v1.8.1
 	golang.org/x/sys v0.28.0